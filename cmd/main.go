@@ -10,6 +10,6 @@ func main() {
 	p := kms.New()
 
 	catalog.PluginMain(
-		catalog.MakePlugin("kms", keymanager.PluginServer(p)),
+		catalog.MakePlugin(kms.PluginName, keymanager.PluginServer(p)),
 	)
 }
@@ -2,12 +2,24 @@ package kms
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
 	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/kms"
 	"github.com/golang/protobuf/proto"
 	"github.com/hashicorp/go-hclog"
@@ -19,32 +31,208 @@ import (
 
 var (
 	kmsErr = errs.Class("kms")
+
+	// ErrUnsupportedSignerOpts is returned (wrapped) by SignData when the
+	// signer opts are of an unknown type
+	ErrUnsupportedSignerOpts = errors.New("unsupported signer opts")
+
+	// aliasNameRegexp matches the alias names accepted by KMS
+	aliasNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9:/_-]+$`)
+	// tagRegexp matches the tag keys and values accepted by KMS
+	tagRegexp = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
 )
 
 const (
+	// PluginName is the name the plugin is registered with in SPIRE
+	PluginName = "kms"
+	// Version of the plugin, reported by GetPluginInfo
+	Version = "0.1.0"
+
+	pluginCategory    = "KeyManager"
+	pluginDescription = "Creates and maintains keys in AWS KMS, and signs data with them"
+
 	aliasPrefix      = "alias/"
 	defaultKeyPrefix = "SPIRE_SERVER_KEY/"
-
-	keyIDTag = "key_id"
-	aliasTag = "alias"
+	maxAliasLength   = 256
+
+	// Bounds accepted by KMS for the waiting period before a key is deleted
+	minKeyDeletionWindowDays     = 7
+	maxKeyDeletionWindowDays     = 30
+	defaultKeyDeletionWindowDays = minKeyDeletionWindowDays
+
+	// Keys discovered at once, each needing a few KMS calls
+	defaultDiscoveryConcurrency = 5
+	// Keys created at once by GenerateKeys. max_concurrent_creates still
+	// applies on top of it.
+	generateKeysConcurrency = 5
+
+	// A created key may not be visible to GetPublicKey right away
+	createdKeyLookupAttempts = 5
+	createdKeyLookupDelay    = 200 * time.Millisecond
+
+	// How often a replaced key is checked for Sign calls in flight before it
+	// is scheduled for deletion
+	signWaitInterval = 10 * time.Millisecond
+
+	// spireKeyUsage is the usage of every key of the plugin: SPIRE keys are
+	// only used to sign, never to encrypt
+	spireKeyUsage = kms.KeyUsageTypeSignVerify
+
+	// refreshJitter is the largest random delay added to refresh_interval,
+	// as a fraction of it
+	refreshJitter = 0.1
+
+	// maxRawMessageSize is the largest message KMS hashes itself
+	maxRawMessageSize = 4096
+
+	// Encodings of the ECDSA signatures returned by SignData: ASN.1 DER, as
+	// returned by KMS, or the concatenation of r and s
+	signatureEncodingDER = "der"
+	signatureEncodingRaw = "raw"
+
+	// Code of the errors returned when IAM denies a call, which the KMS
+	// package has no constant for
+	accessDeniedErrCode = "AccessDeniedException"
+
+	keyIDTag      = "key_id"
+	aliasTag      = "alias"
+	spireKeyIDTag = "spire_key_id"
+
+	// Tags set on the keys created by the plugin, used to recognize them
+	// during discovery regardless of their alias or description.
+	keyPrefixTagKey  = "spire-server-key-prefix"
+	spireKeyIDTagKey = "spire-server-key-id"
+	// requestIDTagKey identifies the GenerateKey call that created a key, so
+	// that a retried CreateKey finds the key created by a lost attempt
+	requestIDTagKey = "spire-server-request-id"
+	// Constraints of KMS on the tags of a key
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+	maxTagsPerKey     = 50
+
+	// schemaVersionTagKey holds the version of the tag scheme a key was
+	// created with, so that the scheme can change without losing the keys
+	// created before. Keys without it (v0) are recognized as they were
+	// before; those already tagged by this server get the version tag when
+	// discovered.
+	schemaVersionTagKey = "spire-kms-schema"
+	schemaVersion       = "1"
 )
 
 type keyEntry struct {
-	KMSKeyID  string
-	Alias     string
-	PublicKey *keymanager.PublicKey
+	KMSKeyID string
+	Alias    string
+	// CreationDate orders the keys of an entry. It is the zero time, older
+	// than any other key, when KMS doesn't return it.
+	CreationDate time.Time
+	PublicKey    *keymanager.PublicKey
+	// ParsedPublicKey is PublicKey.PkixData parsed, an *ecdsa.PublicKey or
+	// an *rsa.PublicKey
+	ParsedPublicKey crypto.PublicKey
+
+	// LoadedAt is when the key was last fetched from KMS
+	LoadedAt time.Time
+	// Cached is set on the entries loaded from the cache file, until their
+	// key is verified to still exist in KMS
+	Cached bool
+	// Disabled is set by DisableKey, so that SignData refuses the key
+	Disabled bool
+	// SigningAlgorithms are the algorithms KMS supports for the key. It is
+	// empty when unknown, e.g. for the entries of an older cache file.
+	SigningAlgorithms []string
 }
 
 // Plugin is the main representation of this keymanager plugin
 type Plugin struct {
 	log       hclog.Logger
+	metrics   Metrics
 	mu        sync.RWMutex
 	entries   map[string]keyEntry
 	kmsClient kmsClient
 	keyPrefix string
 
+	keyDeletionWindowDays int64
+	pruneKeys             bool
+	disableKeyDeletion    bool
+	readOnly              bool
+	verifySignatures      bool
+	reuseKeys             bool
+	managedKeys           map[string]string
+	defaultKeySpec        string
+	keySpecs              map[string]string
+	configuredKeyTags     map[string]string
+	publicKeyTTL          time.Duration
+	discoveryConcurrency  int
+	maxKeys               int
+	discoverByAliasPrefix bool
+	signatureEncoding     string
+
+	// createKeySem bounds the concurrent calls to CreateKey, when
+	// max_concurrent_creates is set
+	createKeySem chan struct{}
+
+	// configuredKeyPolicy is the policy attached to the created keys. When
+	// empty, a policy is generated for serverPrincipal, which is resolved by
+	// Configure when needed: the configured principal or role, or else the
+	// caller identity returned by STS.
+	configuredKeyPolicy string
+	serverPrincipal     string
+
+	// grantPrincipal is granted the use of the created keys, and grants
+	// holds the id of the grant of each created key. Protected by mu.
+	grantPrincipal string
+	grants         map[string]string
+
+	// deletedKeys holds the ids of the KMS keys replaced by GenerateKey. They
+	// are scheduled for deletion and must not be brought back by a discovery
+	// that raced with the replacement. Protected by mu.
+	deletedKeys map[string]struct{}
+
+	// signsInFlight counts the Sign calls in flight per KMS key id, so that
+	// a replaced key is only scheduled for deletion once the calls that
+	// picked it before the replacement are done. Protected by mu.
+	signsInFlight map[string]int
+
+	// replacements counts the calls to replaceEntry, and replacedAt holds the
+	// count at which each entry was last replaced. They let a refresh tell
+	// the entries replaced while the aliases were listed. Protected by mu.
+	replacements uint64
+	replacedAt   map[string]uint64
+
+	describeCache *describeCache
+
+	// cachePath is the file the entries are saved to, to be loaded on the
+	// next start instead of discovering the keys. It is only loaded with the
+	// region it was written for.
+	cachePath   string
+	region      string
+	cacheFileMu sync.Mutex
+
+	// stopRefresh stops the periodic refresh of the entries, if running
+	stopRefresh func()
+
+	// deletionQueue holds the replaced keys until the next flush, when
+	// deferKeyDeletion is set. stopDeletionFlush stops the periodic flush,
+	// if running.
+	deletionQueue     *deletionQueue
+	deferKeyDeletion  bool
+	stopDeletionFlush func()
+
+	// background is the context of the work that outlives the calls, such
+	// as the deletion of replaced keys. It is cancelled by Close, which then
+	// waits for backgroundWG.
+	background       context.Context
+	cancelBackground context.CancelFunc
+	backgroundWG     sync.WaitGroup
+	closeOnce        sync.Once
+
+	// config is set WithConfig, and used by Configure when it gets no
+	// configuration
+	config *Config
+
 	hooks struct {
-		newClient func(config *Config) (kmsClient, error)
+		newClient    func(config *Config) (kmsClient, error)
+		newSTSClient func(config *Config) (stsClient, error)
 	}
 }
 
@@ -53,26 +241,102 @@ type Config struct {
 	AccessKeyID     string `hcl:"access_key_id" json:"access_key_id"`
 	SecretAccessKey string `hcl:"secret_access_key" json:"secret_access_key"`
 	Region          string `hcl:"region" json:"region"`
+	FallbackRegion  string `hcl:"fallback_region" json:"fallback_region"`
 	KeyPrefix       string `hcl:"key_prefix" json:"key_prefix"`
+	AssumeRoleARN   string `hcl:"assume_role_arn" json:"assume_role_arn"`
+	RoleSessionName string `hcl:"role_session_name" json:"role_session_name"`
+	KMSEndpoint     string `hcl:"kms_endpoint" json:"kms_endpoint"`
+	UseFIPSEndpoint bool   `hcl:"use_fips_endpoint" json:"use_fips_endpoint"`
+	Profile         string `hcl:"profile" json:"profile"`
+	HTTPProxy       string `hcl:"http_proxy" json:"http_proxy"`
+	CABundlePath    string `hcl:"ca_bundle_path" json:"ca_bundle_path"`
+
+	// CredentialSource restricts where the credentials are taken from:
+	// static, environment, instance or default (the SDK credential chain)
+	CredentialSource string `hcl:"credential_source" json:"credential_source"`
+
+	WebIdentityRoleARN   string `hcl:"web_identity_role_arn" json:"web_identity_role_arn"`
+	WebIdentityTokenFile string `hcl:"web_identity_token_file" json:"web_identity_token_file"`
+
+	KeyDeletionWindowDays int64  `hcl:"key_deletion_window_days" json:"key_deletion_window_days"`
+	MaxRetries            *int   `hcl:"max_retries" json:"max_retries"`
+	RequestTimeout        string `hcl:"request_timeout" json:"request_timeout"`
+	RefreshInterval       string `hcl:"refresh_interval" json:"refresh_interval"`
+	KeyPolicy             string `hcl:"key_policy" json:"key_policy"`
+	ServerPrincipalARN    string `hcl:"server_principal_arn" json:"server_principal_arn"`
+	PruneKeys             bool   `hcl:"prune_keys" json:"prune_keys"`
+	VerifySignatures      bool   `hcl:"verify_signatures" json:"verify_signatures"`
+	DescribeCacheTTL      string `hcl:"describe_cache_ttl" json:"describe_cache_ttl"`
+	PublicKeyTTL          string `hcl:"public_key_ttl" json:"public_key_ttl"`
+	DiscoveryConcurrency  int    `hcl:"discovery_concurrency" json:"discovery_concurrency"`
+	ValidateOnly          bool   `hcl:"validate_only" json:"validate_only"`
+	CreateGrantFor        string `hcl:"create_grant_for" json:"create_grant_for"`
+	ReuseKeys             bool   `hcl:"reuse_keys" json:"reuse_keys"`
+	CachePath             string `hcl:"cache_path" json:"cache_path"`
+	MaxConcurrentCreates  int    `hcl:"max_concurrent_creates" json:"max_concurrent_creates"`
+	DisableKeyDeletion    bool   `hcl:"disable_key_deletion" json:"disable_key_deletion"`
+	ReadOnly              bool   `hcl:"read_only" json:"read_only"`
+	DefaultKeySpec        string `hcl:"default_key_spec" json:"default_key_spec"`
+	MaxKeys               int    `hcl:"max_keys" json:"max_keys"`
+	DiscoverByAliasPrefix bool   `hcl:"discover_by_alias_prefix" json:"discover_by_alias_prefix"`
+	SignatureEncoding     string `hcl:"signature_encoding" json:"signature_encoding"`
+	DeletionFlushInterval string `hcl:"deletion_flush_interval" json:"deletion_flush_interval"`
+
+	// ManagedKeys maps SPIRE key ids to the ARNs of keys provisioned outside
+	// of SPIRE. When set, only these keys are used.
+	ManagedKeys map[string]string `hcl:"managed_keys" json:"managed_keys"`
+
+	// KeySpecs maps SPIRE key ids to the KMS key spec used when GenerateKey
+	// is called without a key type, instead of DefaultKeySpec.
+	KeySpecs map[string]string `hcl:"key_specs" json:"key_specs"`
+
+	// KeyTags are set on every created key, along with the tags of the
+	// plugin.
+	KeyTags map[string]string `hcl:"key_tags" json:"key_tags"`
 }
 
-// New returns an instantiated plugin
-func New() *Plugin {
-	return newPlugin(newKMSClient)
+// New returns an instantiated plugin. Without options, it is configured by
+// SPIRE through Configure.
+func New(opts ...Option) *Plugin {
+	p := newPlugin(newKMSClient)
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
 }
 
 func newPlugin(newClient func(config *Config) (kmsClient, error)) *Plugin {
 	p := &Plugin{}
+	p.log = hclog.Default()
 	p.hooks.newClient = newClient
+	p.hooks.newSTSClient = newSTSClient
+	p.metrics = nopMetrics{}
 	p.entries = make(map[string]keyEntry)
+	p.deletedKeys = make(map[string]struct{})
+	p.signsInFlight = make(map[string]int)
+	p.deletionQueue = newDeletionQueue()
+	p.background, p.cancelBackground = context.WithCancel(context.Background())
+	p.replacedAt = make(map[string]uint64)
+	p.grants = make(map[string]string)
 	return p
 }
 
-//SetLogger sets a logger
+// SetLogger sets the logger of the plugin. SPIRE injects its own logger, so
+// that the logs of the plugin go through its formatting and levels. The
+// default logger is only used when none is set.
 func (p *Plugin) SetLogger(log hclog.Logger) {
+	if log == nil {
+		log = hclog.Default()
+	}
 	p.log = log
 }
 
+// SetMetrics sets the metrics the calls to KMS and the tracked keys are
+// reported to. It must be called before Configure.
+func (p *Plugin) SetMetrics(metrics Metrics) {
+	p.metrics = metrics
+}
+
 // Configure sets up the plugin
 func (p *Plugin) Configure(ctx context.Context, req *plugin.ConfigureRequest) (*plugin.ConfigureResponse, error) {
 	config, err := p.validateConfig(req.Configuration)
@@ -80,45 +344,234 @@ func (p *Plugin) Configure(ctx context.Context, req *plugin.ConfigureRequest) (*
 		return nil, err
 	}
 
+	if p.stopRefresh != nil {
+		p.stopRefresh()
+		p.stopRefresh = nil
+	}
+	if p.stopDeletionFlush != nil {
+		p.stopDeletionFlush()
+		p.stopDeletionFlush = nil
+	}
+
 	p.keyPrefix = config.KeyPrefix
+	p.keyDeletionWindowDays = config.KeyDeletionWindowDays
+	p.pruneKeys = config.PruneKeys
+	p.disableKeyDeletion = config.DisableKeyDeletion
+	p.readOnly = config.ReadOnly
+	p.deferKeyDeletion = config.DeletionFlushInterval != ""
+	p.verifySignatures = config.VerifySignatures
+	p.reuseKeys = config.ReuseKeys
+	p.managedKeys = config.ManagedKeys
+	p.defaultKeySpec = config.DefaultKeySpec
+	p.keySpecs = config.KeySpecs
+	p.discoveryConcurrency = config.DiscoveryConcurrency
+	p.maxKeys = config.MaxKeys
+	p.discoverByAliasPrefix = config.DiscoverByAliasPrefix
+	p.signatureEncoding = config.SignatureEncoding
+	p.configuredKeyTags = config.KeyTags
+	p.createKeySem = nil
+	if config.MaxConcurrentCreates > 0 {
+		p.createKeySem = make(chan struct{}, config.MaxConcurrentCreates)
+	}
+	p.configuredKeyPolicy = config.KeyPolicy
+	p.serverPrincipal = config.ServerPrincipalARN
+	if p.serverPrincipal == "" {
+		p.serverPrincipal = config.AssumeRoleARN
+	}
+	p.grantPrincipal = config.CreateGrantFor
+	p.cachePath = config.CachePath
+	p.region = config.Region
 
-	p.kmsClient, err = p.hooks.newClient(config)
+	client, err := p.hooks.newClient(config)
 	if err != nil {
 		return nil, kmsErr.New("failed to create KMS client: %v", err)
 	}
-
-	p.log.Debug("Fetching keys from KMS")
-	var nextMarker *string
-	for {
-		nextMarker, err = p.fetchAliasesPage(ctx, nextMarker)
+	// STS is only needed to find out the caller identity, for the key policy
+	// or as retiring principal of the grants. It is called once, rather than
+	// for every created key.
+	if (config.KeyPolicy == "" || config.CreateGrantFor != "") && p.serverPrincipal == "" {
+		stsClient, err := p.hooks.newSTSClient(config)
+		if err != nil {
+			return nil, kmsErr.New("failed to create STS client: %v", err)
+		}
+		p.serverPrincipal, err = callerPrincipal(ctx, stsClient)
 		if err != nil {
 			return nil, err
 		}
-		if nextMarker == nil {
-			break
+	}
+	// Durations were validated along with the rest of the configuration
+	requestTimeout, _ := time.ParseDuration(config.RequestTimeout)
+	p.kmsClient = newRetryClient(newMetricsClient(client, p.metrics), requestTimeout, *config.MaxRetries)
+	if config.FallbackRegion != "" {
+		fallbackConfig := *config
+		fallbackConfig.Region = config.FallbackRegion
+		fallback, err := p.hooks.newClient(&fallbackConfig)
+		if err != nil {
+			return nil, kmsErr.New("failed to create KMS client for the fallback region: %v", err)
+		}
+		fallback = newRetryClient(newMetricsClient(fallback, p.metrics), requestTimeout, *config.MaxRetries)
+		p.kmsClient = newFallbackClient(p.kmsClient, fallback, config.FallbackRegion, func(op, keyID string, err error) {
+			p.log.Warn("Calling KMS in the fallback region", "operation", op, keyIDTag, keyID, "region", config.FallbackRegion, "error", wrapAWSErr(op, err))
+		})
+	}
+	describeCacheTTL, _ := time.ParseDuration(config.DescribeCacheTTL)
+	p.describeCache = newDescribeCache(describeCacheTTL)
+	p.publicKeyTTL, _ = time.ParseDuration(config.PublicKeyTTL)
+
+	// Only checks that KMS can be reached with the configuration, e.g. to
+	// lint it, without discovering the keys
+	if config.ValidateOnly {
+		p.resetEntries()
+		if err := p.healthCheck(ctx); err != nil {
+			return nil, err
+		}
+		p.log.Info("Validated configuration, keys were not discovered")
+		return &plugin.ConfigureResponse{}, nil
+	}
+
+	// The cache file saves discovering the keys on start. Its entries are
+	// verified when first used, and a periodic refresh still discovers the
+	// keys created or deleted out-of-band.
+	loaded := false
+	if p.cachePath != "" {
+		loaded, err = p.loadCacheFile()
+		if err != nil {
+			p.log.Warn("Ignored unusable cache file, keys are discovered in KMS", "error", err, "path", p.cachePath)
 		}
 	}
 
+	// The entries are rebuilt from the new client. When that fails, the keys
+	// of the previous configuration are dropped rather than used with it.
+	if !loaded {
+		if err := p.refreshEntries(ctx); err != nil {
+			p.resetEntries()
+			return nil, err
+		}
+		p.saveCacheFile()
+	}
+
+	if config.RefreshInterval != "" {
+		refreshInterval, _ := time.ParseDuration(config.RefreshInterval)
+		p.startRefresh(refreshInterval)
+	}
+	if config.DeletionFlushInterval != "" {
+		deletionFlushInterval, _ := time.ParseDuration(config.DeletionFlushInterval)
+		p.startDeletionFlush(deletionFlushInterval)
+	}
+
 	return &plugin.ConfigureResponse{}, nil
 }
 
 //GenerateKey creates a key in KMS. If a key already exist in the local storage, it is updated.
 func (p *Plugin) GenerateKey(ctx context.Context, req *keymanager.GenerateKeyRequest) (*keymanager.GenerateKeyResponse, error) {
+	if err := p.checkConfigured(); err != nil {
+		return nil, err
+	}
 	if req.KeyId == "" {
 		return nil, kmsErr.New("key id is required")
 	}
+	spireKeyID := req.KeyId
 	if req.KeyType == keymanager.KeyType_UNSPECIFIED_KEY_TYPE {
-		return nil, kmsErr.New("key type is required")
+		keyType, ok := p.configuredKeyType(spireKeyID)
+		if !ok {
+			return nil, kmsErr.New("key type is required")
+		}
+		req = &keymanager.GenerateKeyRequest{KeyId: spireKeyID, KeyType: keyType}
 	}
 
-	spireKeyID := req.KeyId
+	if p.managedKeys != nil {
+		return p.generateManagedKey(spireKeyID, req.KeyType)
+	}
+	if p.readOnly {
+		return p.generateReadOnlyKey(spireKeyID, req.KeyType)
+	}
+
+	// The alias is created after the key, so an id that can't be part of an
+	// alias name has to be rejected before
+	if err := validateAliasName(p.aliasFromSpireKeyID(spireKeyID)); err != nil {
+		return nil, kmsErr.New("invalid key id %q: %v", spireKeyID, err)
+	}
+
+	// SPIRE expects a new key, so reusing the current one is opt-in. It
+	// avoids churn when GenerateKey is retried.
+	if entry, ok := p.entry(spireKeyID); ok && p.reuseKeys && entry.PublicKey.Type == req.KeyType {
+		p.log.Info("Reused existing key", spireKeyIDTag, spireKeyID, keyIDTag, entry.KMSKeyID)
+		return &keymanager.GenerateKeyResponse{
+			PublicKey: clonePublicKey(entry.PublicKey),
+		}, nil
+	}
+
+	newEntry, err := p.rotateKey(ctx, spireKeyID, req.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	p.log.Info("Key generated", spireKeyIDTag, spireKeyID, keyIDTag, newEntry.KMSKeyID)
+
+	return &keymanager.GenerateKeyResponse{
+		PublicKey: clonePublicKey(newEntry.PublicKey),
+	}, nil
+
+}
+
+// generateReadOnlyKey returns the current key of spireKeyID, when the plugin
+// is read-only: keys are provisioned separately, so they are never created,
+// replaced or deleted.
+func (p *Plugin) generateReadOnlyKey(spireKeyID string, keyType keymanager.KeyType) (*keymanager.GenerateKeyResponse, error) {
+	entry, ok := p.entry(spireKeyID)
+	if !ok {
+		return nil, kmsErr.New("key %q does not exist and can't be created, the plugin is read-only", spireKeyID)
+	}
+	if entry.PublicKey.Type != keyType {
+		return nil, kmsErr.New("key %q is of type %v, %v was requested, and can't be replaced, the plugin is read-only", spireKeyID, entry.PublicKey.Type, keyType)
+	}
 
-	newEntry, err := p.createKey(ctx, spireKeyID, req.KeyType)
+	p.log.Info("Returned existing key, the plugin is read-only", spireKeyIDTag, spireKeyID, keyIDTag, entry.KMSKeyID)
+	return &keymanager.GenerateKeyResponse{
+		PublicKey: clonePublicKey(entry.PublicKey),
+	}, nil
+}
+
+// RotateKey replaces the current key of the given id with a new key of
+// keyType, or of the type of the current key when unspecified, regardless of
+// reuse_keys. The alias is repointed to the new key and the old key is
+// scheduled for deletion; when the alias can't be repointed, the new key is
+// deleted and the current key is kept.
+func (p *Plugin) RotateKey(ctx context.Context, spireKeyID string, keyType keymanager.KeyType) (*keymanager.PublicKey, error) {
+	if err := p.checkConfigured(); err != nil {
+		return nil, err
+	}
+	if p.managedKeys != nil {
+		return nil, kmsErr.New("managed keys are rotated outside of the plugin")
+	}
+	if p.readOnly {
+		return nil, kmsErr.New("keys can't be rotated, the plugin is read-only")
+	}
+	entry, ok := p.entry(spireKeyID)
+	if !ok {
+		return nil, kmsErr.New("no such key %q", spireKeyID)
+	}
+	if keyType == keymanager.KeyType_UNSPECIFIED_KEY_TYPE {
+		keyType = entry.PublicKey.Type
+	}
+
+	newEntry, err := p.rotateKey(ctx, spireKeyID, keyType)
 	if err != nil {
 		return nil, err
 	}
+	p.log.Info("Key rotated", spireKeyIDTag, spireKeyID, keyIDTag, newEntry.KMSKeyID, "replaced_key_id", entry.KMSKeyID)
+	return clonePublicKey(newEntry.PublicKey), nil
+}
+
+// rotateKey creates a new key for spireKeyID, points its alias to it and
+// replaces the entry, then deletes the replaced key, if any. The new key is
+// deleted when its alias can't be created or updated.
+func (p *Plugin) rotateKey(ctx context.Context, spireKeyID string, keyType keymanager.KeyType) (keyEntry, error) {
+	newEntry, err := p.createKey(ctx, spireKeyID, keyType)
+	if err != nil {
+		return keyEntry{}, err
+	}
 
-	oldEntry, hasOldEntry := p.entry(spireKeyID)
+	_, hasOldEntry := p.entry(spireKeyID)
 
 	if !hasOldEntry {
 		//create alias
@@ -126,8 +579,17 @@ func (p *Plugin) GenerateKey(ctx context.Context, req *keymanager.GenerateKeyReq
 			AliasName:   aws.String(newEntry.Alias),
 			TargetKeyId: &newEntry.KMSKeyID,
 		})
+		if isAWSErrorCode(err, kms.ErrCodeAlreadyExistsException) {
+			// The alias points to a key that was not loaded (e.g. a disabled
+			// one), so it is repointed to the new key.
+			_, err = p.kmsClient.UpdateAliasWithContext(ctx, &kms.UpdateAliasInput{
+				AliasName:   aws.String(newEntry.Alias),
+				TargetKeyId: &newEntry.KMSKeyID,
+			})
+		}
 		if err != nil {
-			return nil, kmsErr.New("failed to create alias: %v", err)
+			p.scheduleKeyDeletion(p.background, spireKeyID, newEntry.KMSKeyID)
+			return keyEntry{}, kmsErr.New("failed to create alias %q for key %q: %w", newEntry.Alias, spireKeyID, withDeniedAction(err, "kms:CreateAlias", newEntry.KMSKeyID))
 		}
 
 	} else {
@@ -137,68 +599,165 @@ func (p *Plugin) GenerateKey(ctx context.Context, req *keymanager.GenerateKeyReq
 			TargetKeyId: &newEntry.KMSKeyID,
 		})
 		if err != nil {
-			return nil, kmsErr.New("failed to update alias: %v", err)
+			p.scheduleKeyDeletion(p.background, spireKeyID, newEntry.KMSKeyID)
+			return keyEntry{}, kmsErr.New("failed to update alias %q for key %q: %w", newEntry.Alias, spireKeyID, withDeniedAction(err, "kms:UpdateAlias", newEntry.KMSKeyID))
 		}
 
+	}
+
+	// The entry is read again when replaced: a concurrent refresh may have
+	// changed it since it was read above.
+	oldEntry, replaced, err := p.replaceEntry(spireKeyID, newEntry)
+	var stale *staleEntryError
+	if errors.As(err, &stale) {
+		p.discardRejectedKey(ctx, spireKeyID, newEntry, stale.current)
+		return keyEntry{}, err
+	}
+	if err != nil {
+		return keyEntry{}, err
+	}
+	if replaced {
+		p.backgroundWG.Add(1)
 		go func() {
-			//schedule delete
-			c, cancel := context.WithTimeout(context.Background(), time.Second*30)
-			defer cancel()
-			_, err = p.kmsClient.ScheduleKeyDeletionWithContext(c, &kms.ScheduleKeyDeletionInput{
-				KeyId:               &oldEntry.KMSKeyID,
-				PendingWindowInDays: aws.Int64(7),
-			})
-			if err != nil {
-				p.log.Error("It was not possible to schedule deletion for key", "error", err, keyIDTag, &oldEntry.KMSKeyID)
-			}
+			defer p.backgroundWG.Done()
+			p.waitForSigns(oldEntry.KMSKeyID)
+			p.deleteReplacedKey(spireKeyID, oldEntry.KMSKeyID)
 		}()
 	}
+	p.saveCacheFile()
+	return newEntry, nil
+}
 
-	err = p.setEntry(spireKeyID, newEntry)
+// discardRejectedKey undoes a rotation whose key was rejected by replaceEntry,
+// because a newer key replaced the entry concurrently. The alias is pointed
+// back at the current key, in case it was updated last, and the rejected key is
+// scheduled for deletion. The key is kept when the alias can't be restored, so
+// that the alias doesn't point to a key pending deletion.
+func (p *Plugin) discardRejectedKey(ctx context.Context, spireKeyID string, rejected, current keyEntry) {
+	_, err := p.kmsClient.UpdateAliasWithContext(ctx, &kms.UpdateAliasInput{
+		AliasName:   aws.String(rejected.Alias),
+		TargetKeyId: aws.String(current.KMSKeyID),
+	})
 	if err != nil {
-		return nil, err
+		p.log.Error("It was not possible to point the alias back at the current key", "error", wrapAWSErr("kms:UpdateAlias", err), spireKeyIDTag, spireKeyID, keyIDTag, rejected.KMSKeyID, "current_key_id", current.KMSKeyID)
+		return
 	}
-
-	return &keymanager.GenerateKeyResponse{
-		PublicKey: clonePublicKey(newEntry.PublicKey),
-	}, nil
-
+	p.scheduleKeyDeletion(p.background, spireKeyID, rejected.KMSKeyID)
 }
 
 // SignData creates a digital signature for the data to be signed
 func (p *Plugin) SignData(ctx context.Context, req *keymanager.SignDataRequest) (*keymanager.SignDataResponse, error) {
+	resp, _, err := p.SignDataWithAlgorithm(ctx, req)
+	return resp, err
+}
+
+// SignDataWithAlgorithm is like SignData, and also returns the KMS signing
+// algorithm the data was signed with (e.g. ECDSA_SHA_256), for auditing.
+func (p *Plugin) SignDataWithAlgorithm(ctx context.Context, req *keymanager.SignDataRequest) (*keymanager.SignDataResponse, string, error) {
+	return p.signData(ctx, req, kms.MessageTypeDigest, p.signatureEncoding, "")
+}
+
+// signData signs req.Data with KMS, and returns the signing algorithm used.
+// The data is a digest, as SPIRE sends it, unless messageType is RAW, in
+// which case KMS hashes it. ECDSA signatures are returned in the given
+// encoding. When kmsKeyID is set, the data is only signed if the entry is
+// still backed by that key.
+func (p *Plugin) signData(ctx context.Context, req *keymanager.SignDataRequest, messageType, signatureEncoding, kmsKeyID string) (*keymanager.SignDataResponse, string, error) {
+	if err := p.checkConfigured(); err != nil {
+		return nil, "", err
+	}
 	if req.KeyId == "" {
-		return nil, kmsErr.New("key id is required")
+		return nil, "", kmsErr.New("key id is required")
 	}
 	if req.SignerOpts == nil {
-		return nil, kmsErr.New("signer opts is required")
+		return nil, "", kmsErr.New("signer opts is required")
 	}
 
-	keyEntry, hasKey := p.entry(req.KeyId)
-	if !hasKey {
-		return nil, kmsErr.New("no such key %q", req.KeyId)
+	keyEntry, done, err := p.signingEntry(req.KeyId, kmsKeyID)
+	if err != nil {
+		return nil, "", err
+	}
+	defer done()
+	if keyEntry.Disabled {
+		return nil, "", kmsErr.New("key %q is disabled, it has to be enabled or generated again", req.KeyId)
+	}
+	if keyEntry.Cached {
+		var err error
+		keyEntry, err = p.verifyCachedEntry(ctx, req.KeyId, keyEntry)
+		if err != nil {
+			return nil, "", err
+		}
 	}
 
 	signingAlgo, err := signingAlgorithmForKMS(keyEntry.PublicKey.Type, req.SignerOpts)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	if err := checkSigningAlgorithm(req.KeyId, keyEntry, signingAlgo); err != nil {
+		return nil, "", err
+	}
+
+	hash := hashForSigningAlgorithm(signingAlgo)
+	digest := req.Data
+	if messageType == kms.MessageTypeRaw {
+		if len(req.Data) == 0 || len(req.Data) > maxRawMessageSize {
+			return nil, "", kmsErr.New("message must be between 1 and %d bytes, got %d bytes", maxRawMessageSize, len(req.Data))
+		}
+		h := hash.New()
+		_, _ = h.Write(req.Data)
+		digest = h.Sum(nil)
+	} else if len(req.Data) != hash.Size() {
+		// KMS only receives the digest of the data, which must match the
+		// hash of the signing algorithm
+		return nil, "", kmsErr.New("data must be a %d byte digest for signing algorithm %s, got %d bytes", hash.Size(), signingAlgo, len(req.Data))
 	}
 
 	signResp, err := p.kmsClient.SignWithContext(ctx, &kms.SignInput{
-		KeyId:            &keyEntry.Alias,
+		KeyId:            aws.String(keyEntry.signingKeyID()),
 		Message:          req.Data,
-		MessageType:      aws.String(kms.MessageTypeDigest),
+		MessageType:      aws.String(messageType),
 		SigningAlgorithm: aws.String(signingAlgo),
 	})
-	if err != nil {
-		return nil, kmsErr.New("failed to sign: %v", err)
+	switch {
+	case isAWSErrorCode(err, kms.ErrCodeNotFoundException),
+		isAWSErrorCode(err, kms.ErrCodeDisabledException),
+		isAWSErrorCode(err, kms.ErrCodeInvalidStateException):
+		// The key was deleted or disabled out-of-band, so the entry is
+		// stale and a new key has to be generated
+		p.evictEntry(req.KeyId, keyEntry.KMSKeyID)
+		p.saveCacheFile()
+		err = wrapAWSErr("kms:Sign", err)
+		p.log.Warn("Evicted key that can no longer sign", "error", err, spireKeyIDTag, req.KeyId, keyIDTag, keyEntry.KMSKeyID, "key_state", p.currentKeyState(ctx, keyEntry.KMSKeyID))
+		return nil, "", kmsErr.New("key %q is no longer usable in KMS and has to be generated again: %w", req.KeyId, classifyError(err))
+	case err != nil:
+		return nil, "", kmsErr.New("failed to sign data with key %q: %w", req.KeyId, withDeniedAction(err, "kms:Sign", keyEntry.KMSKeyID))
+	case len(signResp.Signature) == 0:
+		return nil, "", kmsErr.New("failed to sign data with key %q: response is missing Signature", req.KeyId)
+	}
+
+	if p.verifySignatures {
+		if err := verifySignature(keyEntry.ParsedPublicKey, signingAlgo, digest, signResp.Signature); err != nil {
+			return nil, "", kmsErr.New("signature returned by KMS for key %q does not verify: %v", req.KeyId, err)
+		}
+	}
+
+	signature := signResp.Signature
+	if publicKey, ok := keyEntry.ParsedPublicKey.(*ecdsa.PublicKey); ok && signatureEncoding == signatureEncodingRaw {
+		signature, err = rawECDSASignature(publicKey, signature)
+		if err != nil {
+			return nil, "", kmsErr.New("failed to encode signature returned by KMS for key %q: %v", req.KeyId, err)
+		}
 	}
 
-	return &keymanager.SignDataResponse{Signature: signResp.Signature}, nil
+	return &keymanager.SignDataResponse{Signature: signature}, signingAlgo, nil
 }
 
 // GetPublicKey returns the public key for a given key
 func (p *Plugin) GetPublicKey(ctx context.Context, req *keymanager.GetPublicKeyRequest) (*keymanager.GetPublicKeyResponse, error) {
+	if err := p.checkConfigured(); err != nil {
+		return nil, err
+	}
 	if req.KeyId == "" {
 		return nil, kmsErr.New("key id is required")
 	}
@@ -207,6 +766,21 @@ func (p *Plugin) GetPublicKey(ctx context.Context, req *keymanager.GetPublicKeyR
 	if !ok {
 		return nil, kmsErr.New("no such key %q", req.KeyId)
 	}
+	if entry.Cached {
+		var err error
+		entry, err = p.verifyCachedEntry(ctx, req.KeyId, entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.publicKeyTTL > 0 && time.Since(entry.LoadedAt) >= p.publicKeyTTL {
+		var err error
+		entry, err = p.reloadEntry(ctx, req.KeyId, entry)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return &keymanager.GetPublicKeyResponse{
 		PublicKey: clonePublicKey(entry.PublicKey),
@@ -215,23 +789,134 @@ func (p *Plugin) GetPublicKey(ctx context.Context, req *keymanager.GetPublicKeyR
 }
 
 // GetPublicKeys return the publicKey for all the keys
+// The keys loaded from the cache file are returned without being verified.
 func (p *Plugin) GetPublicKeys(context.Context, *keymanager.GetPublicKeysRequest) (*keymanager.GetPublicKeysResponse, error) {
-	var keys []*keymanager.PublicKey
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	for _, key := range p.entries {
-		keys = append(keys, clonePublicKey(key.PublicKey))
+	if err := p.checkConfigured(); err != nil {
+		return nil, err
 	}
+	return &keymanager.GetPublicKeysResponse{PublicKeys: p.publicKeys()}, nil
+}
 
-	return &keymanager.GetPublicKeysResponse{PublicKeys: keys}, nil
+// checkConfigured fails until Configure created the KMS client, so that the
+// calls made before return an error rather than panic on the nil client
+func (p *Plugin) checkConfigured() error {
+	if p.kmsClient == nil {
+		return kmsErr.New("plugin not configured")
+	}
+	return nil
 }
 
 // GetPluginInfo returns information about this plugin
 func (p *Plugin) GetPluginInfo(context.Context, *plugin.GetPluginInfoRequest) (*plugin.GetPluginInfoResponse, error) {
-	return &plugin.GetPluginInfoResponse{}, nil
+	return &plugin.GetPluginInfoResponse{
+		Name:        PluginName,
+		Category:    pluginCategory,
+		Type:        pluginCategory,
+		Description: pluginDescription,
+		Version:     Version,
+	}, nil
+}
+
+// PruneKeys schedules the deletion of the keys of this server whose SPIRE key
+// id is not one of spireKeyIDs. Only the keys tagged by the plugin with the
+// key prefix of this server are deleted; keys created by older versions, which
+// have no tags, are left alone. It fails unless prune_keys is enabled.
+func (p *Plugin) PruneKeys(ctx context.Context, spireKeyIDs []string) error {
+	if err := p.checkConfigured(); err != nil {
+		return err
+	}
+	if !p.pruneKeys {
+		return kmsErr.New("pruning keys is disabled")
+	}
+
+	inUse := make(map[string]bool, len(spireKeyIDs))
+	for _, spireKeyID := range spireKeyIDs {
+		inUse[spireKeyID] = true
+	}
+
+	for _, publicKey := range p.publicKeys() {
+		spireKeyID := publicKey.Id
+		entry, ok := p.entry(spireKeyID)
+		if !ok || inUse[spireKeyID] {
+			continue
+		}
+
+		tags, err := p.keyTags(ctx, &entry.Alias, &entry.KMSKeyID)
+		if err != nil {
+			return err
+		}
+		if tags[keyPrefixTagKey] != p.keyPrefix || tags[spireKeyIDTagKey] != spireKeyID {
+			p.log.Debug("Skipped pruning key", "reason", "key is not tagged by this server", spireKeyIDTag, spireKeyID, keyIDTag, entry.KMSKeyID)
+			continue
+		}
+
+		p.retireGrant(ctx, spireKeyID, entry.KMSKeyID)
+		_, err = p.kmsClient.ScheduleKeyDeletionWithContext(ctx, &kms.ScheduleKeyDeletionInput{
+			KeyId:               aws.String(entry.KMSKeyID),
+			PendingWindowInDays: aws.Int64(p.keyDeletionWindowDays),
+		})
+		if err != nil {
+			return kmsErr.New("failed to schedule deletion of key %q: %w", spireKeyID, withDeniedAction(err, "kms:ScheduleKeyDeletion", entry.KMSKeyID))
+		}
+		p.removeEntry(spireKeyID, entry.KMSKeyID)
+		p.saveCacheFile()
+		p.log.Info("Pruned key", spireKeyIDTag, spireKeyID, keyIDTag, entry.KMSKeyID)
+	}
+	return nil
+}
+
+// healthCheck makes a cheap call to KMS, to tell whether the configured
+// credentials and region still work
+func (p *Plugin) healthCheck(ctx context.Context) error {
+	_, err := p.kmsClient.ListKeysWithContext(ctx, &kms.ListKeysInput{Limit: aws.Int64(1)})
+	if err != nil {
+		return kmsErr.New("health check failed: %w", withDeniedAction(err, "kms:ListKeys", ""))
+	}
+	return nil
+}
+
+// staleEntryError is returned by replaceEntry when the entry is older than
+// the current one, which is kept
+type staleEntryError struct {
+	rejected keyEntry
+	current  keyEntry
+}
+
+func (e *staleEntryError) Error() string {
+	return fmt.Sprintf("key %q was rejected, since the newer key %q replaced it", e.rejected.KMSKeyID, e.current.KMSKeyID)
+}
+
+// replaceEntry sets the entry of spireKeyID and returns the entry it
+// displaced, if any. The displaced key is marked as deleted so that it is not
+// rediscovered. Reading and replacing the current entry happens under a single
+// lock, so that a concurrent refresh can't slip in between. An entry older than
+// the current one is rejected with a staleEntryError.
+func (p *Plugin) replaceEntry(spireKeyID string, entry keyEntry) (keyEntry, bool, error) {
+	if err := validateEntry(spireKeyID, entry); err != nil {
+		return keyEntry{}, false, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current, ok := p.entries[spireKeyID]
+	// Keep the newest key when the entry was replaced concurrently
+	if ok && entry.CreationDate.Before(current.CreationDate) {
+		p.log.Info("Rejected stale key entry", spireKeyIDTag, spireKeyID, keyIDTag, entry.KMSKeyID, "current_key_id", current.KMSKeyID)
+		return keyEntry{}, false, kmsErr.New("failed to replace key %q: %w", spireKeyID, &staleEntryError{rejected: entry, current: current})
+	}
+	p.entries[spireKeyID] = entry
+	p.reportEntryCount()
+	p.replacements++
+	p.replacedAt[spireKeyID] = p.replacements
+	if !ok || current.KMSKeyID == entry.KMSKeyID {
+		return keyEntry{}, false, nil
+	}
+	p.deletedKeys[current.KMSKeyID] = struct{}{}
+	return current, true, nil
 }
 
-func (p *Plugin) setEntry(spireKeyID string, entry keyEntry) error {
+func validateEntry(spireKeyID string, entry keyEntry) error {
 	if spireKeyID == "" {
 		return kmsErr.New("spireKeyID is required")
 	}
@@ -253,11 +938,81 @@ func (p *Plugin) setEntry(spireKeyID string, entry keyEntry) error {
 	if entry.PublicKey.PkixData == nil || len(entry.PublicKey.PkixData) == 0 {
 		return kmsErr.New("PublicKey.PkixData is required")
 	}
+	return nil
+}
 
+// resetEntries removes every entry
+func (p *Plugin) resetEntries() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.entries[spireKeyID] = entry
-	return nil
+
+	p.entries = make(map[string]keyEntry)
+	p.reportEntryCount()
+}
+
+// reportEntryCount sets the entries gauge to the number of entries. It must
+// be called with mu held.
+func (p *Plugin) reportEntryCount() {
+	p.metrics.SetGauge(entriesMetricKey, float32(len(p.entries)))
+}
+
+// removeEntry removes the entry of spireKeyID if it still refers to the given
+// key, which is being deleted
+func (p *Plugin) removeEntry(spireKeyID, kmsKeyID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if entry, ok := p.entries[spireKeyID]; ok && entry.KMSKeyID == kmsKeyID {
+		delete(p.entries, spireKeyID)
+		p.reportEntryCount()
+	}
+	p.deletedKeys[kmsKeyID] = struct{}{}
+}
+
+// evictEntry removes the entry with the given id, if it still holds the KMS
+// key with the given id. Unlike removeEntry, the key is not marked as deleted,
+// so a refresh picks it up again if it becomes usable.
+func (p *Plugin) evictEntry(spireKeyID, kmsKeyID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if entry, ok := p.entries[spireKeyID]; ok && entry.KMSKeyID == kmsKeyID {
+		delete(p.entries, spireKeyID)
+		p.reportEntryCount()
+	}
+}
+
+// publicKeys returns a copy of the public keys of every entry, sorted by id
+func (p *Plugin) publicKeys() []*keymanager.PublicKey {
+	var keys []*keymanager.PublicKey
+	p.rangeEntries(func(spireKeyID string, entry *keyEntry) bool {
+		keys = append(keys, clonePublicKey(entry.PublicKey))
+		return true
+	})
+	return keys
+}
+
+// rangeEntries calls f with each entry, sorted by SPIRE key id, until f
+// returns false. The entries are only copied under the lock, which is released
+// before they are sorted and f is called, so f may take a while or use the
+// other methods of the plugin. f gets copies: changing them has no effect.
+func (p *Plugin) rangeEntries(f func(spireKeyID string, entry *keyEntry) bool) {
+	p.mu.RLock()
+	spireKeyIDs := make([]string, 0, len(p.entries))
+	entries := make(map[string]keyEntry, len(p.entries))
+	for spireKeyID, entry := range p.entries {
+		spireKeyIDs = append(spireKeyIDs, spireKeyID)
+		entries[spireKeyID] = entry
+	}
+	p.mu.RUnlock()
+
+	sort.Strings(spireKeyIDs)
+	for _, spireKeyID := range spireKeyIDs {
+		entry := entries[spireKeyID]
+		if !f(spireKeyID, &entry) {
+			return
+		}
+	}
 }
 
 func (p *Plugin) entry(spireKeyID string) (keyEntry, bool) {
@@ -267,6 +1022,63 @@ func (p *Plugin) entry(spireKeyID string) (keyEntry, bool) {
 	return value, hasKey
 }
 
+// signingEntry is like entry, and counts a Sign call in flight on the key of
+// the entry until done is called. Both happen under a single lock, so that
+// GenerateKey can't replace the entry and miss the call. When kmsKeyID is set,
+// the entry must still be backed by that key, which is checked under the same
+// lock.
+func (p *Plugin) signingEntry(spireKeyID, kmsKeyID string) (entry keyEntry, done func(), err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry, ok := p.entries[spireKeyID]
+	if !ok {
+		return keyEntry{}, nil, kmsErr.New("no such key %q", spireKeyID)
+	}
+	if kmsKeyID != "" && entry.KMSKeyID != kmsKeyID {
+		return keyEntry{}, nil, kmsErr.New("key %q was replaced since the signer was created", spireKeyID)
+	}
+
+	p.signsInFlight[entry.KMSKeyID]++
+	return entry, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.signsInFlight[entry.KMSKeyID]--
+		if p.signsInFlight[entry.KMSKeyID] == 0 {
+			delete(p.signsInFlight, entry.KMSKeyID)
+		}
+	}, nil
+}
+
+// waitForSigns waits until no Sign call is in flight on a key, or Close is
+// called. Sign calls are bounded by the request timeout.
+func (p *Plugin) waitForSigns(kmsKeyID string) {
+	for {
+		p.mu.Lock()
+		inFlight := p.signsInFlight[kmsKeyID]
+		p.mu.Unlock()
+		if inFlight == 0 {
+			return
+		}
+
+		select {
+		case <-p.background.Done():
+			return
+		case <-time.After(signWaitInterval):
+		}
+	}
+}
+
+// signingKeyID returns the key id Sign is called with: the key of the entry
+// rather than its alias, since GenerateKey points the alias to the new key
+// before the entry is replaced. Managed keys are called by their ARN, as they
+// may be in another account.
+func (e keyEntry) signingKeyID() string {
+	if isKeyARN(e.Alias) {
+		return e.Alias
+	}
+	return e.KMSKeyID
+}
+
 func (p *Plugin) createKey(ctx context.Context, spireKeyID string, keyType keymanager.KeyType) (keyEntry, error) {
 	res := keyEntry{}
 	description := p.descriptionFromSpireKeyID(spireKeyID)
@@ -275,113 +1087,692 @@ func (p *Plugin) createKey(ctx context.Context, spireKeyID string, keyType keyma
 		return res, err
 	}
 
+	policy, err := p.keyPolicy()
+	if err != nil {
+		return res, err
+	}
+	requestID, ok := requestIDFromContext(ctx)
+	if !ok {
+		requestID, err = newRequestID()
+		if err != nil {
+			return res, kmsErr.New("failed to generate request id: %v", err)
+		}
+	} else if len(requestID) > maxTagValueLength {
+		return res, kmsErr.New("request id is longer than %d characters", maxTagValueLength)
+	}
+
 	createKeyInput := &kms.CreateKeyInput{
 		Description:           aws.String(description),
-		KeyUsage:              aws.String(kms.KeyUsageTypeSignVerify),
+		Policy:                aws.String(policy),
+		KeyUsage:              aws.String(spireKeyUsage),
 		CustomerMasterKeySpec: aws.String(keySpec),
+		Tags: []*kms.Tag{
+			{TagKey: aws.String(keyPrefixTagKey), TagValue: aws.String(p.keyPrefix)},
+			{TagKey: aws.String(spireKeyIDTagKey), TagValue: aws.String(spireKeyID)},
+			{TagKey: aws.String(requestIDTagKey), TagValue: aws.String(requestID)},
+			{TagKey: aws.String(schemaVersionTagKey), TagValue: aws.String(schemaVersion)},
+		},
+	}
+	tagKeys := make([]string, 0, len(p.configuredKeyTags))
+	for tagKey := range p.configuredKeyTags {
+		tagKeys = append(tagKeys, tagKey)
+	}
+	sort.Strings(tagKeys)
+	for _, tagKey := range tagKeys {
+		createKeyInput.Tags = append(createKeyInput.Tags, &kms.Tag{TagKey: aws.String(tagKey), TagValue: aws.String(p.configuredKeyTags[tagKey])})
 	}
 
-	key, err := p.kmsClient.CreateKeyWithContext(ctx, createKeyInput)
+	key, err := p.callCreateKey(ctx, createKeyInput)
 	if err != nil {
-		return res, kmsErr.New("failed to create key: %v", err)
+		return res, kmsErr.New("failed to create key %q: %w", spireKeyID, withDeniedAction(err, "kms:CreateKey", ""))
+	}
+	if err := validateKeyMetadata(key.KeyMetadata); err != nil {
+		return res, kmsErr.New("failed to create key %q: %v", spireKeyID, err)
 	}
 
-	pub, err := p.kmsClient.GetPublicKeyWithContext(ctx, &kms.GetPublicKeyInput{KeyId: key.KeyMetadata.KeyId})
+	pub, err := p.getCreatedPublicKey(ctx, *key.KeyMetadata.KeyId)
+	if err != nil {
+		p.scheduleKeyDeletion(p.background, spireKeyID, *key.KeyMetadata.KeyId)
+		return res, kmsErr.New("failed to get public key for key %q: %w", spireKeyID, withDeniedAction(err, "kms:GetPublicKey", *key.KeyMetadata.KeyId))
+	}
+	parsedPublicKey, err := parsePublicKey(spireKeyID, pub.PublicKey)
 	if err != nil {
-		return res, kmsErr.New("failed to get public key: %v", err)
+		p.scheduleKeyDeletion(p.background, spireKeyID, *key.KeyMetadata.KeyId)
+		return res, err
+	}
+	if p.grantPrincipal != "" {
+		if err := p.createGrant(ctx, spireKeyID, *key.KeyMetadata.KeyId); err != nil {
+			p.scheduleKeyDeletion(p.background, spireKeyID, *key.KeyMetadata.KeyId)
+			return res, err
+		}
 	}
 
 	res = keyEntry{
-		KMSKeyID: *pub.KeyId,
-		Alias:    p.aliasFromSpireKeyID(spireKeyID),
+		KMSKeyID:     *key.KeyMetadata.KeyId,
+		Alias:        p.aliasFromSpireKeyID(spireKeyID),
+		CreationDate: aws.TimeValue(key.KeyMetadata.CreationDate),
+		LoadedAt:     time.Now(),
 		PublicKey: &keymanager.PublicKey{
 			Id:       spireKeyID,
 			Type:     keyType,
 			PkixData: pub.PublicKey,
 		},
+		ParsedPublicKey:   parsedPublicKey,
+		SigningAlgorithms: aws.StringValueSlice(key.KeyMetadata.SigningAlgorithms),
 	}
 
 	return res, nil
 }
 
-func (p *Plugin) buildKeyEntry(ctx context.Context, alias *string, awsKeyID *string) (*keyEntry, error) {
-	l := p.log.With(keyIDTag, *awsKeyID, aliasTag, alias)
-	describeResp, err := p.kmsClient.DescribeKeyWithContext(ctx, &kms.DescribeKeyInput{KeyId: alias})
-	if err != nil {
-		return nil, kmsErr.New("failed to describe key: %v", err)
-	}
+// getCreatedPublicKey gets the public key of a key that was just created.
+// KMS is eventually consistent, so NotFound errors are retried for a short
+// while, apart from the retries of the client.
+func (p *Plugin) getCreatedPublicKey(ctx context.Context, kmsKeyID string) (*kms.GetPublicKeyOutput, error) {
+	for attempt := 1; ; attempt++ {
+		pub, err := p.kmsClient.GetPublicKeyWithContext(ctx, &kms.GetPublicKeyInput{KeyId: aws.String(kmsKeyID)})
+		if !isAWSErrorCode(err, kms.ErrCodeNotFoundException) || attempt >= createdKeyLookupAttempts {
+			return pub, err
+		}
+		p.log.Debug("Created key is not visible yet", keyIDTag, kmsKeyID, "attempt", attempt)
 
-	if *describeResp.KeyMetadata.Enabled == false {
-		l.Debug("Skipped disabled key")
-		return nil, nil
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(createdKeyLookupDelay):
+		}
 	}
+}
 
-	spireKeyID, err := p.spireKeyIDFromAlias(*alias)
+// callCreateKey calls CreateKey once fewer than max_concurrent_creates calls
+// are in flight, since the creations of a bulk rotation count against the
+// limits of the account
+func (p *Plugin) callCreateKey(ctx context.Context, input *kms.CreateKeyInput) (*kms.CreateKeyOutput, error) {
+	// Checked here rather than where the input is built, so that no code
+	// path creates a key SPIRE can't use
+	if err := checkKeyUsage(aws.StringValue(input.KeyUsage)); err != nil {
+		return nil, err
+	}
+
+	sem := p.createKeySem
+	if sem != nil {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		defer func() { <-sem }()
+	}
+	return p.kmsClient.CreateKeyWithContext(ctx, input)
+}
+
+// scheduleKeyDeletion schedules the deletion of a key that is no longer (or
+// was never) referenced by an alias. When key deletion is disabled, the key is
+// disabled instead, so that it is retained. Failures are only logged, since
+// the key can still be deleted manually, except when ctx is cancelled by Close:
+// the key is then queued again, for Close to flush it.
+func (p *Plugin) scheduleKeyDeletion(ctx context.Context, spireKeyID, kmsKeyID string) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	p.retireGrant(ctx, spireKeyID, kmsKeyID)
+	if p.disableKeyDeletion {
+		_, err := p.kmsClient.DisableKeyWithContext(ctx, &kms.DisableKeyInput{KeyId: aws.String(kmsKeyID)})
+		if err != nil {
+			p.log.Error("It was not possible to disable key", "error", wrapAWSErr("kms:DisableKey", err), spireKeyIDTag, spireKeyID, keyIDTag, kmsKeyID)
+			p.requeueCancelledDeletion(ctx, spireKeyID, kmsKeyID)
+			return
+		}
+		p.log.Info("Key disabled instead of scheduled for deletion", spireKeyIDTag, spireKeyID, keyIDTag, kmsKeyID)
+		return
+	}
+
+	_, err := p.kmsClient.ScheduleKeyDeletionWithContext(ctx, &kms.ScheduleKeyDeletionInput{
+		KeyId:               aws.String(kmsKeyID),
+		PendingWindowInDays: aws.Int64(p.keyDeletionWindowDays),
+	})
 	if err != nil {
+		p.log.Error("It was not possible to schedule deletion for key", "error", wrapAWSErr("kms:ScheduleKeyDeletion", err), spireKeyIDTag, spireKeyID, keyIDTag, kmsKeyID)
+		p.requeueCancelledDeletion(ctx, spireKeyID, kmsKeyID)
+		return
+	}
+	p.log.Info("Key scheduled for deletion", spireKeyIDTag, spireKeyID, keyIDTag, kmsKeyID)
+}
+
+// requeueCancelledDeletion queues a key whose deletion failed again, when it
+// failed because ctx was cancelled rather than timed out
+func (p *Plugin) requeueCancelledDeletion(ctx context.Context, spireKeyID, kmsKeyID string) {
+	if ctx.Err() != context.Canceled {
+		return
+	}
+	p.deletionQueue.add(spireKeyID, kmsKeyID)
+	p.log.Debug("Queued key deletion", spireKeyIDTag, spireKeyID, keyIDTag, kmsKeyID)
+}
+
+// currentKeyState describes a key again, bypassing the describe cache, and
+// returns its state for the logs. It returns "unknown" when the key can't be
+// described.
+func (p *Plugin) currentKeyState(ctx context.Context, kmsKeyID string) string {
+	p.describeCache.forget(kmsKeyID)
+	metadata, err := p.describeKey(ctx, kmsKeyID)
+	if err != nil {
+		return "unknown"
+	}
+	return aws.StringValue(metadata.KeyState)
+}
+
+// describeKey returns the metadata of a key, from the cache when it was
+// described recently
+func (p *Plugin) describeKey(ctx context.Context, awsKeyID string) (*kms.KeyMetadata, error) {
+	if metadata, ok := p.describeCache.get(awsKeyID); ok {
+		return metadata, nil
+	}
+
+	describeResp, err := p.kmsClient.DescribeKeyWithContext(ctx, &kms.DescribeKeyInput{KeyId: aws.String(awsKeyID)})
+	if err != nil {
+		return nil, err
+	}
+	if err := validateKeyMetadata(describeResp.KeyMetadata); err != nil {
+		return nil, err
+	}
+	p.describeCache.put(awsKeyID, describeResp.KeyMetadata)
+	return describeResp.KeyMetadata, nil
+}
+
+// validateKeyMetadata fails when a KMS response has no key metadata, or
+// metadata without a key id, so that a malformed response is reported rather
+// than dereferenced. The other fields are read with the aws helpers.
+func validateKeyMetadata(metadata *kms.KeyMetadata) error {
+	switch {
+	case metadata == nil:
+		return errors.New("response is missing KeyMetadata")
+	case metadata.KeyId == nil:
+		return errors.New("response is missing KeyMetadata.KeyId")
+	}
+	return nil
+}
+
+func (p *Plugin) buildKeyEntry(ctx context.Context, alias *string, awsKeyID *string) (*keyEntry, error) {
+	l := p.log.With(keyIDTag, *awsKeyID, aliasTag, alias)
+	metadata, err := p.describeKey(ctx, *awsKeyID)
+	if err != nil {
+		return nil, kmsErr.New("failed to describe key %q (%s): %w", *alias, *awsKeyID, withDeniedAction(err, "kms:DescribeKey", *awsKeyID))
+	}
+
+	if keyState := aws.StringValue(metadata.KeyState); keyState != kms.KeyStateEnabled {
+		l.Debug("Skipped key", "reason", "key is not enabled", "key_state", keyState)
+		return nil, nil
+	}
+
+	if err := checkKeyUsage(aws.StringValue(metadata.KeyUsage)); err != nil {
 		l.Debug("Skipped key", "reason", err)
 		return nil, nil
 	}
 
-	keyType, err := keyTypeFromKeySpec(*describeResp.KeyMetadata.CustomerMasterKeySpec)
+	spireKeyID, unversioned, err := p.spireKeyIDFromKey(ctx, alias, awsKeyID)
+	if err != nil {
+		return nil, err
+	}
+	if spireKeyID == "" {
+		l.Debug("Skipped key", "reason", "key does not belong to this server")
+		return nil, nil
+	}
+
+	keyType, err := keyTypeFromKeySpec(aws.StringValue(metadata.CustomerMasterKeySpec))
 	if err != nil {
 		l.Debug("Skipped key", "reason", err)
 		return nil, nil
 	}
 
-	getPublicKeyResp, err := p.kmsClient.GetPublicKeyWithContext(ctx, &kms.GetPublicKeyInput{KeyId: alias})
+	getPublicKeyResp, err := p.kmsClient.GetPublicKeyWithContext(ctx, &kms.GetPublicKeyInput{KeyId: awsKeyID})
 	if err != nil {
-		return nil, kmsErr.New("failed to get public key: %v", err)
+		return nil, kmsErr.New("failed to get public key for key %q (%s): %w", *alias, *awsKeyID, withDeniedAction(err, "kms:GetPublicKey", *awsKeyID))
+	}
+	parsedPublicKey, err := parsePublicKey(spireKeyID, getPublicKeyResp.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if unversioned && !p.readOnly {
+		p.migrateUnversionedKey(ctx, spireKeyID, *awsKeyID)
 	}
 
 	return &keyEntry{
-		KMSKeyID: *awsKeyID,
-		Alias:    *alias,
+		KMSKeyID:     *awsKeyID,
+		Alias:        *alias,
+		CreationDate: aws.TimeValue(metadata.CreationDate),
+		LoadedAt:     time.Now(),
+		PublicKey: &keymanager.PublicKey{
+			Id:       spireKeyID,
+			Type:     keyType,
+			PkixData: getPublicKeyResp.PublicKey,
+		},
+		ParsedPublicKey:   parsedPublicKey,
+		SigningAlgorithms: aws.StringValueSlice(metadata.SigningAlgorithms),
+	}, nil
+}
+
+// reloadEntry fetches the key of an entry again, through its alias, so that a
+// key changed out-of-band is reflected. The entry is updated unless it was
+// replaced meanwhile.
+func (p *Plugin) reloadEntry(ctx context.Context, spireKeyID string, stale keyEntry) (keyEntry, error) {
+	describeResp, err := p.kmsClient.DescribeKeyWithContext(ctx, &kms.DescribeKeyInput{KeyId: aws.String(stale.Alias)})
+	if err != nil {
+		return keyEntry{}, kmsErr.New("failed to describe key %q: %w", spireKeyID, withDeniedAction(err, "kms:DescribeKey", stale.KMSKeyID))
+	}
+	if err := validateKeyMetadata(describeResp.KeyMetadata); err != nil {
+		return keyEntry{}, kmsErr.New("failed to describe key %q: %v", spireKeyID, err)
+	}
+	metadata := describeResp.KeyMetadata
+
+	keyType, err := keyTypeFromKeySpec(aws.StringValue(metadata.CustomerMasterKeySpec))
+	if err != nil {
+		return keyEntry{}, kmsErr.New("key %q is not supported: %v", spireKeyID, err)
+	}
+
+	getPublicKeyResp, err := p.kmsClient.GetPublicKeyWithContext(ctx, &kms.GetPublicKeyInput{KeyId: metadata.KeyId})
+	if err != nil {
+		return keyEntry{}, kmsErr.New("failed to get public key for key %q: %w", spireKeyID, withDeniedAction(err, "kms:GetPublicKey", aws.StringValue(metadata.KeyId)))
+	}
+	parsedPublicKey, err := parsePublicKey(spireKeyID, getPublicKeyResp.PublicKey)
+	if err != nil {
+		return keyEntry{}, err
+	}
+
+	entry := keyEntry{
+		KMSKeyID:     aws.StringValue(metadata.KeyId),
+		Alias:        stale.Alias,
+		CreationDate: aws.TimeValue(metadata.CreationDate),
+		LoadedAt:     time.Now(),
 		PublicKey: &keymanager.PublicKey{
 			Id:       spireKeyID,
 			Type:     keyType,
 			PkixData: getPublicKeyResp.PublicKey,
 		},
-	}, err
+		ParsedPublicKey:   parsedPublicKey,
+		SigningAlgorithms: aws.StringValueSlice(metadata.SigningAlgorithms),
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if current, ok := p.entries[spireKeyID]; ok && current.KMSKeyID == stale.KMSKeyID && current.LoadedAt.Equal(stale.LoadedAt) {
+		p.entries[spireKeyID] = entry
+	}
+	return entry, nil
 }
 
-func (p *Plugin) fetchAliasesPage(ctx context.Context, marker *string) (*string, error) {
+// refreshEntries discovers the keys of this server in KMS, and replaces the
+// entries with them, so keys created or deleted out-of-band are reflected.
+func (p *Plugin) refreshEntries(ctx context.Context) error {
+	p.log.Debug("Fetching keys from KMS")
+
+	p.mu.RLock()
+	started := p.replacements
+	p.mu.RUnlock()
+
+	entries := make(map[string]keyEntry)
+	if p.managedKeys != nil {
+		if err := p.loadManagedKeys(ctx, entries); err != nil {
+			return err
+		}
+	} else {
+		var nextMarker *string
+		for {
+			var err error
+			nextMarker, err = p.fetchAliasesPage(ctx, nextMarker, entries)
+			if err != nil {
+				return err
+			}
+			if nextMarker == nil {
+				break
+			}
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for spireKeyID, entry := range entries {
+		if _, deleted := p.deletedKeys[entry.KMSKeyID]; deleted {
+			p.log.Debug("Skipped key scheduled for deletion", spireKeyIDTag, spireKeyID, keyIDTag, entry.KMSKeyID)
+			delete(entries, spireKeyID)
+		}
+	}
+	// Disabled keys are skipped by the discovery, but the entries disabled
+	// by DisableKey are kept so that SignData refuses them explicitly
+	for spireKeyID, current := range p.entries {
+		if _, ok := entries[spireKeyID]; !ok && current.Disabled {
+			entries[spireKeyID] = current
+		}
+	}
+	// Keys generated while the aliases were listed may be missing from the
+	// listing, or be newer than the listed ones
+	for spireKeyID, current := range p.entries {
+		if p.replacedAt[spireKeyID] <= started {
+			continue
+		}
+		if entry, ok := entries[spireKeyID]; !ok || entry.CreationDate.Before(current.CreationDate) {
+			entries[spireKeyID] = current
+		}
+	}
+	p.entries = entries
+	p.reportEntryCount()
+	p.metrics.IncrCounter(refreshesMetricKey, 1, nil)
+	return nil
+}
+
+// Close stops the periodic refresh of the entries and the background work,
+// flushes the queued key deletions, then saves the entries to the cache file.
+// It is safe to call more than once.
+func (p *Plugin) Close() error {
+	p.closeOnce.Do(func() {
+		if p.stopRefresh != nil {
+			p.stopRefresh()
+			p.stopRefresh = nil
+		}
+		if p.stopDeletionFlush != nil {
+			p.stopDeletionFlush()
+			p.stopDeletionFlush = nil
+		}
+		p.cancelBackground()
+		p.backgroundWG.Wait()
+		// The background context is done, but the queued keys still have to
+		// be deleted
+		p.flushDeletions(context.Background(), nil)
+		p.saveCacheFile()
+	})
+	return nil
+}
+
+// startRefresh refreshes the entries every interval, with some jitter, until
+// stopRefresh is called.
+func (p *Plugin) startRefresh(interval time.Duration) {
+	ctx, cancel := context.WithCancel(p.background)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		timer := time.NewTimer(refreshDelay(interval))
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+				if err := p.refreshEntries(ctx); err != nil {
+					p.log.Error("Failed to refresh keys from KMS", "error", err)
+				} else {
+					p.saveCacheFile()
+				}
+				timer.Reset(refreshDelay(interval))
+			}
+		}
+	}()
+
+	p.stopRefresh = func() {
+		cancel()
+		<-done
+	}
+}
+
+// refreshDelay returns interval plus a random jitter of up to refreshJitter of
+// it, so that the servers started together don't all list the keys at the
+// same time. The jitter is drawn from crypto/rand, since the default
+// math/rand source is seeded the same in every process.
+func refreshDelay(interval time.Duration) time.Duration {
+	maxJitter := int64(float64(interval) * refreshJitter)
+	if maxJitter <= 0 {
+		return interval
+	}
+	jitter, err := cryptorand.Int(cryptorand.Reader, big.NewInt(maxJitter+1))
+	if err != nil {
+		return interval
+	}
+	return interval + time.Duration(jitter.Int64())
+}
+
+func (p *Plugin) fetchAliasesPage(ctx context.Context, marker *string, entries map[string]keyEntry) (*string, error) {
 	aliasesResp, err := p.kmsClient.ListAliasesWithContext(ctx, &kms.ListAliasesInput{
 		Marker: marker,
 	})
 	if err != nil {
-		return nil, kmsErr.New("failed to fetch keys: %v", err)
+		return nil, kmsErr.New("failed to list aliases: %w", withDeniedAction(err, "kms:ListAliases", ""))
 	}
 
 	p.log.Debug(fmt.Sprintf("%v keys were found", len(aliasesResp.Aliases)))
 
+	var aliases []*kms.AliasListEntry
 	for _, alias := range aliasesResp.Aliases {
 		if alias.AliasName == nil || alias.TargetKeyId == nil {
 			continue
 		}
-		l := p.log.With(keyIDTag, *alias.TargetKeyId, aliasTag, *alias.AliasName)
-		l.Debug("Processing key")
-		entry, err := p.buildKeyEntry(ctx, alias.AliasName, alias.TargetKeyId)
+		// The keys are still recognized by their tags, but only the keys
+		// with an alias of this server are described
+		if p.discoverByAliasPrefix && !strings.HasPrefix(*alias.AliasName, aliasPrefix+p.keyPrefix) {
+			continue
+		}
+		aliases = append(aliases, alias)
+	}
+	results := p.buildKeyEntries(ctx, aliases)
+
+	for i, alias := range aliases {
+		entry, err := results[i].entry, results[i].err
 		switch {
 		case err != nil:
-			return nil, kmsErr.New("failed to process KMS key: %v", err)
+			return nil, err
 		case entry != nil:
-			err := p.setEntry(entry.PublicKey.Id, *entry)
-			l.Debug("Added key")
-			if err != nil {
+			if err := validateEntry(entry.PublicKey.Id, *entry); err != nil {
 				return nil, err
 			}
+			current, ok := entries[entry.PublicKey.Id]
+			if !ok && p.maxKeys > 0 && len(entries) >= p.maxKeys {
+				// The remaining pages are not listed either
+				p.log.Warn("Stopped discovering keys, max_keys was reached", "max_keys", p.maxKeys)
+				return nil, nil
+			}
+			if ok && current.KMSKeyID != entry.KMSKeyID {
+				// e.g. left behind by an interrupted rotation. The newest key
+				// is used, the other one has to be cleaned up.
+				used, ignored := *entry, current
+				if entry.CreationDate.Before(current.CreationDate) {
+					used, ignored = current, *entry
+				}
+				p.log.Warn("Found several keys for the same SPIRE key id, using the newest one", spireKeyIDTag, entry.PublicKey.Id, keyIDTag, used.KMSKeyID, "ignored_key_id", ignored.KMSKeyID)
+				if used.KMSKeyID != entry.KMSKeyID {
+					continue
+				}
+			}
+			entries[entry.PublicKey.Id] = *entry
+			p.log.Debug("Added key", keyIDTag, *alias.TargetKeyId, aliasTag, *alias.AliasName)
 		}
 	}
 	return aliasesResp.NextMarker, nil
 }
 
+type keyEntryResult struct {
+	entry *keyEntry
+	err   error
+}
+
+// buildKeyEntries builds the entries of the given aliases, with up to
+// discoveryConcurrency keys processed at once. A failing key doesn't stop the
+// others; the results are returned in the order of the aliases, so the
+// caller sees the errors in a stable order.
+func (p *Plugin) buildKeyEntries(ctx context.Context, aliases []*kms.AliasListEntry) []keyEntryResult {
+	concurrency := p.discoveryConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]keyEntryResult, len(aliases))
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for i, alias := range aliases {
+		i, alias := i, alias
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			p.log.Debug("Processing key", keyIDTag, *alias.TargetKeyId, aliasTag, *alias.AliasName)
+			entry, err := p.buildKeyEntry(ctx, alias.AliasName, alias.TargetKeyId)
+			results[i] = keyEntryResult{entry: entry, err: err}
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// spireKeyIDFromKey returns the SPIRE key id of a KMS key, or an empty string
+// if the key was not created by this server. How the id is read depends on
+// the schema version tag of the key: current keys carry it in their tags,
+// while v0 keys may only have it in their alias. It also reports whether the
+// key is a v0 key tagged by this server, which can be migrated. Keys of a
+// newer schema are skipped, so that an older server leaves them alone.
+func (p *Plugin) spireKeyIDFromKey(ctx context.Context, alias *string, awsKeyID *string) (string, bool, error) {
+	tags, err := p.keyTags(ctx, alias, awsKeyID)
+	if err != nil {
+		return "", false, err
+	}
+
+	switch version := tags[schemaVersionTagKey]; version {
+	case schemaVersion:
+		if tags[keyPrefixTagKey] != p.keyPrefix {
+			return "", false, nil
+		}
+		return tags[spireKeyIDTagKey], false, nil
+	case "":
+	default:
+		p.log.Warn("Skipped key of an unsupported schema version", keyIDTag, *awsKeyID, aliasTag, *alias, "schema_version", version)
+		return "", false, nil
+	}
+
+	if keyPrefix, ok := tags[keyPrefixTagKey]; ok && keyPrefix != p.keyPrefix {
+		return "", false, nil
+	}
+	if spireKeyID, ok := tags[spireKeyIDTagKey]; ok {
+		_, tagged := tags[keyPrefixTagKey]
+		return spireKeyID, tagged, nil
+	}
+
+	spireKeyID, err := p.spireKeyIDFromAlias(*alias)
+	if err != nil {
+		return "", false, nil
+	}
+	return spireKeyID, false, nil
+}
+
+// migrateUnversionedKey sets the schema version tag on a v0 key tagged by
+// this server. Keys only recognized by their alias are not migrated: tagging
+// them would claim keys whose alias may belong to another server, and make
+// them prunable. Failures are only logged, the key is migrated again on the
+// next discovery.
+func (p *Plugin) migrateUnversionedKey(ctx context.Context, spireKeyID, kmsKeyID string) {
+	_, err := p.kmsClient.TagResourceWithContext(ctx, &kms.TagResourceInput{
+		KeyId: aws.String(kmsKeyID),
+		Tags: []*kms.Tag{
+			{TagKey: aws.String(schemaVersionTagKey), TagValue: aws.String(schemaVersion)},
+		},
+	})
+	if err != nil {
+		p.log.Warn("Failed to migrate unversioned key", spireKeyIDTag, spireKeyID, keyIDTag, kmsKeyID, "error", withDeniedAction(err, "kms:TagResource", kmsKeyID))
+		return
+	}
+	p.log.Info("Migrated unversioned key", spireKeyIDTag, spireKeyID, keyIDTag, kmsKeyID, "schema_version", schemaVersion)
+}
+
+func (p *Plugin) keyTags(ctx context.Context, alias *string, awsKeyID *string) (map[string]string, error) {
+	tags := make(map[string]string)
+	var marker *string
+	for {
+		tagsResp, err := p.kmsClient.ListResourceTagsWithContext(ctx, &kms.ListResourceTagsInput{
+			KeyId:  awsKeyID,
+			Marker: marker,
+		})
+		if err != nil {
+			return nil, kmsErr.New("failed to list tags for key %q (%s): %w", *alias, *awsKeyID, withDeniedAction(err, "kms:ListResourceTags", *awsKeyID))
+		}
+		for _, tag := range tagsResp.Tags {
+			tags[aws.StringValue(tag.TagKey)] = aws.StringValue(tag.TagValue)
+		}
+		if tagsResp.NextMarker == nil {
+			break
+		}
+		marker = tagsResp.NextMarker
+	}
+	return tags, nil
+}
+
 func (p *Plugin) spireKeyIDFromAlias(alias string) (string, error) {
-	tokens := strings.SplitAfter(alias, p.keyPrefix)
-	if len(tokens) != 2 {
+	prefix := aliasPrefix + p.keyPrefix
+	if !strings.HasPrefix(alias, prefix) || len(alias) == len(prefix) {
 		return "", fmt.Errorf("alias does not contain SPIRE prefix")
 	}
 
-	return tokens[1], nil
+	return strings.TrimPrefix(alias, prefix), nil
+}
+
+// configuredKeySpec returns the key spec configured for the given SPIRE key
+// id in key_specs, or else in default_key_spec. It is empty when neither is
+// set.
+func (p *Plugin) configuredKeySpec(spireKeyID string) string {
+	if keySpec, ok := p.keySpecs[spireKeyID]; ok {
+		return keySpec
+	}
+	return p.defaultKeySpec
+}
+
+// configuredKeyType returns the key type of configuredKeySpec. It returns
+// false when no spec is configured.
+func (p *Plugin) configuredKeyType(spireKeyID string) (keymanager.KeyType, bool) {
+	keySpec := p.configuredKeySpec(spireKeyID)
+	if keySpec == "" {
+		return keymanager.KeyType_UNSPECIFIED_KEY_TYPE, false
+	}
+	// The spec was validated when configured
+	keyType, err := keyTypeFromKeySpec(keySpec)
+	return keyType, err == nil
+}
+
+// validateKeyTags checks the configured key tags against the constraints of
+// KMS, so that GenerateKey doesn't fail on them. The tags of the plugin can't
+// be overridden.
+func validateKeyTags(tags map[string]string) error {
+	pluginTags := []string{keyPrefixTagKey, spireKeyIDTagKey, requestIDTagKey, schemaVersionTagKey}
+	if len(tags)+len(pluginTags) > maxTagsPerKey {
+		return kmsErr.New("too many key tags, got %d but at most %d are allowed", len(tags), maxTagsPerKey-len(pluginTags))
+	}
+	for tagKey, tagValue := range tags {
+		switch {
+		case tagKey == "" || utf8.RuneCountInString(tagKey) > maxTagKeyLength:
+			return kmsErr.New("key tag %q must be between 1 and %d characters", tagKey, maxTagKeyLength)
+		case utf8.RuneCountInString(tagValue) > maxTagValueLength:
+			return kmsErr.New("value of key tag %q is longer than %d characters", tagKey, maxTagValueLength)
+		case strings.HasPrefix(strings.ToLower(tagKey), "aws:"):
+			return kmsErr.New("key tag %q uses the reserved aws: prefix", tagKey)
+		case !tagRegexp.MatchString(tagKey) || !tagRegexp.MatchString(tagValue):
+			return kmsErr.New("key tag %q can only contain letters, digits, spaces and _.:/=+-@", tagKey)
+		}
+		for _, pluginTag := range pluginTags {
+			if tagKey == pluginTag {
+				return kmsErr.New("key tag %q is set by the plugin", tagKey)
+			}
+		}
+	}
+	return nil
+}
+
+// validateAliasName fails when KMS would reject alias as the name of an alias
+func validateAliasName(alias string) error {
+	switch {
+	case len(alias) > maxAliasLength:
+		return fmt.Errorf("alias %q is longer than %d characters", alias, maxAliasLength)
+	case !aliasNameRegexp.MatchString(alias):
+		return fmt.Errorf("alias %q can only contain letters, digits, '/', '_', '-' and ':'", alias)
+	}
+	return nil
 }
 
 func (p *Plugin) aliasFromSpireKeyID(spireKeyID string) string {
@@ -396,29 +1787,260 @@ func (p *Plugin) descriptionFromSpireKeyID(spireKeyID string) string {
 func (p *Plugin) validateConfig(c string) (*Config, error) {
 	config := new(Config)
 
-	if err := hcl.Decode(config, c); err != nil {
+	if c == "" && p.config != nil {
+		// A plugin created WithConfig can be configured without HCL
+		*config = *p.config
+	} else if err := hcl.Decode(config, c); err != nil {
 		return nil, kmsErr.New("unable to decode configuration: %v", err)
 	}
 
 	if config.Region == "" {
 		return nil, kmsErr.New("configuration is missing a region")
 	}
+	// Catches typos such as us-east1, which would otherwise only fail when
+	// the endpoint is resolved on the first call
+	partition, ok := partitionForRegion(config.Region)
+	if !ok {
+		return nil, kmsErr.New("invalid region %q", config.Region)
+	}
+	// ARNs of another partition (e.g. aws for a GovCloud region) can't be
+	// used, as each partition has its own accounts
+	if config.AssumeRoleARN != "" && arnPartition(config.AssumeRoleARN) != partition {
+		return nil, kmsErr.New("assume role arn %q is not in the %s partition of region %q", config.AssumeRoleARN, partition, config.Region)
+	}
+	if config.ServerPrincipalARN != "" && arnPartition(config.ServerPrincipalARN) != partition {
+		return nil, kmsErr.New("server principal arn %q must be an ARN in the %s partition of region %q", config.ServerPrincipalARN, partition, config.Region)
+	}
 
-	if config.AccessKeyID == "" {
-		p.log.Warn("configuration is missing an access key id, make sure your EC2 instance can access KMS")
+	if config.FallbackRegion != "" {
+		fallbackPartition, ok := partitionForRegion(config.FallbackRegion)
+		switch {
+		case !ok:
+			return nil, kmsErr.New("invalid fallback region %q", config.FallbackRegion)
+		case config.FallbackRegion == config.Region:
+			return nil, kmsErr.New("fallback region must be different from the region %q", config.Region)
+		case fallbackPartition != partition:
+			// Multi-region keys are only replicated within a partition
+			return nil, kmsErr.New("fallback region %q is not in the %s partition of region %q", config.FallbackRegion, partition, config.Region)
+		case config.KMSEndpoint != "":
+			return nil, kmsErr.New("fallback region can't be used with a KMS endpoint")
+		}
+		if config.UseFIPSEndpoint {
+			if _, err := fipsEndpoint(config.FallbackRegion); err != nil {
+				return nil, kmsErr.New("invalid configuration: %v", err)
+			}
+		}
 	}
 
-	if config.SecretAccessKey == "" {
-		p.log.Warn("configuration is missing a secret access key, make sure your EC2 instance can access KMS")
+	if config.HTTPProxy != "" {
+		if _, err := parseProxyURL(config.HTTPProxy); err != nil {
+			return nil, kmsErr.New("invalid HTTP proxy: %v", err)
+		}
+	}
+
+	if config.UseFIPSEndpoint {
+		if config.KMSEndpoint != "" {
+			return nil, kmsErr.New("configuration can't have both a KMS endpoint and use the FIPS endpoint")
+		}
+		if _, err := fipsEndpoint(config.Region); err != nil {
+			return nil, kmsErr.New("invalid configuration: %v", err)
+		}
+	}
+
+	if (config.WebIdentityRoleARN == "") != (config.WebIdentityTokenFile == "") {
+		return nil, kmsErr.New("web identity role arn and web identity token file must be set together")
+	}
+	if config.WebIdentityRoleARN != "" && arnPartition(config.WebIdentityRoleARN) != partition {
+		return nil, kmsErr.New("web identity role arn %q is not in the %s partition of region %q", config.WebIdentityRoleARN, partition, config.Region)
+	}
+
+	hasStaticCredentials := config.AccessKeyID != "" || config.SecretAccessKey != ""
+	switch config.CredentialSource {
+	case "":
+	case credentialSourceStatic:
+		if !hasStaticCredentials {
+			return nil, kmsErr.New("static credential source requires an access key id and a secret access key")
+		}
+	case credentialSourceEnvironment, credentialSourceInstance:
+		if config.Profile != "" {
+			return nil, kmsErr.New("%s credential source can't be combined with a profile", config.CredentialSource)
+		}
+		fallthrough
+	case credentialSourceDefault:
+		if hasStaticCredentials || config.WebIdentityRoleARN != "" {
+			return nil, kmsErr.New("%s credential source can't be combined with static credentials or a web identity", config.CredentialSource)
+		}
+	default:
+		return nil, kmsErr.New("credential source must be one of %s, %s, %s or %s, got %q", credentialSourceStatic, credentialSourceEnvironment, credentialSourceInstance, credentialSourceDefault, config.CredentialSource)
+	}
+
+	switch {
+	case config.WebIdentityRoleARN != "" && (config.Profile != "" || config.AccessKeyID != "" || config.SecretAccessKey != ""):
+		return nil, kmsErr.New("configuration can't have both a web identity and a profile or static credentials")
+	case config.Profile != "" && (config.AccessKeyID != "" || config.SecretAccessKey != ""):
+		return nil, kmsErr.New("configuration can't have both a profile and static credentials")
+	case config.AccessKeyID != "" && config.SecretAccessKey == "":
+		return nil, kmsErr.New("configuration is missing a secret access key")
+	case config.AccessKeyID == "" && config.SecretAccessKey != "":
+		return nil, kmsErr.New("configuration is missing an access key id")
+	case config.CredentialSource == "" && config.Profile == "" && config.WebIdentityRoleARN == "" && config.AccessKeyID == "" && config.SecretAccessKey == "":
+		p.log.Warn("configuration is missing an access key id and a secret access key, make sure your EC2 instance can access KMS")
+	}
+
+	if config.CreateGrantFor != "" && arnPartition(config.CreateGrantFor) != partition {
+		return nil, kmsErr.New("create grant for %q must be an ARN in the %s partition of region %q", config.CreateGrantFor, partition, config.Region)
+	}
+
+	if config.RoleSessionName != "" && config.AssumeRoleARN == "" {
+		return nil, kmsErr.New("configuration has a role session name but is missing an assume role arn")
 	}
 
 	if config.KeyPrefix == "" {
 		config.KeyPrefix = defaultKeyPrefix
 	}
 
+	if config.RequestTimeout == "" {
+		config.RequestTimeout = defaultRequestTimeout.String()
+	}
+	requestTimeout, err := time.ParseDuration(config.RequestTimeout)
+	if err != nil {
+		return nil, kmsErr.New("invalid request timeout: %v", err)
+	}
+	if requestTimeout <= 0 {
+		return nil, kmsErr.New("request timeout must be positive, got %s", config.RequestTimeout)
+	}
+
+	if config.RefreshInterval != "" {
+		refreshInterval, err := time.ParseDuration(config.RefreshInterval)
+		if err != nil {
+			return nil, kmsErr.New("invalid refresh interval: %v", err)
+		}
+		if refreshInterval <= 0 {
+			return nil, kmsErr.New("refresh interval must be positive, got %s", config.RefreshInterval)
+		}
+	}
+
+	if config.DeletionFlushInterval != "" {
+		deletionFlushInterval, err := time.ParseDuration(config.DeletionFlushInterval)
+		if err != nil {
+			return nil, kmsErr.New("invalid deletion flush interval: %v", err)
+		}
+		if deletionFlushInterval <= 0 {
+			return nil, kmsErr.New("deletion flush interval must be positive, got %s", config.DeletionFlushInterval)
+		}
+	}
+
+	if config.DescribeCacheTTL != "" {
+		describeCacheTTL, err := time.ParseDuration(config.DescribeCacheTTL)
+		if err != nil {
+			return nil, kmsErr.New("invalid describe cache TTL: %v", err)
+		}
+		if describeCacheTTL <= 0 {
+			return nil, kmsErr.New("describe cache TTL must be positive, got %s", config.DescribeCacheTTL)
+		}
+	}
+
+	if config.PublicKeyTTL != "" {
+		publicKeyTTL, err := time.ParseDuration(config.PublicKeyTTL)
+		if err != nil {
+			return nil, kmsErr.New("invalid public key TTL: %v", err)
+		}
+		if publicKeyTTL <= 0 {
+			return nil, kmsErr.New("public key TTL must be positive, got %s", config.PublicKeyTTL)
+		}
+	}
+
+	// Unlike the other limits, 0 is valid: it disables the retries
+	switch {
+	case config.MaxRetries == nil:
+		maxRetries := defaultMaxRetries
+		config.MaxRetries = &maxRetries
+	case *config.MaxRetries < 0:
+		return nil, kmsErr.New("max retries cannot be negative, got %d", *config.MaxRetries)
+	}
+
+	switch {
+	case config.DiscoveryConcurrency == 0:
+		config.DiscoveryConcurrency = defaultDiscoveryConcurrency
+	case config.DiscoveryConcurrency < 0:
+		return nil, kmsErr.New("discovery concurrency must be positive, got %d", config.DiscoveryConcurrency)
+	}
+
+	if config.MaxKeys < 0 {
+		return nil, kmsErr.New("max keys cannot be negative, got %d", config.MaxKeys)
+	}
+
+	if config.MaxConcurrentCreates < 0 {
+		return nil, kmsErr.New("max concurrent creates cannot be negative, got %d", config.MaxConcurrentCreates)
+	}
+
+	if config.DisableKeyDeletion && config.PruneKeys {
+		return nil, kmsErr.New("prune keys can't be enabled when key deletion is disabled")
+	}
+
+	if config.ReadOnly && config.PruneKeys {
+		return nil, kmsErr.New("prune keys can't be enabled when the plugin is read-only")
+	}
+
+	if err := validateKeyTags(config.KeyTags); err != nil {
+		return nil, err
+	}
+
+	switch config.SignatureEncoding {
+	case "":
+		config.SignatureEncoding = signatureEncodingDER
+	case signatureEncodingDER, signatureEncodingRaw:
+	default:
+		return nil, kmsErr.New("signature encoding must be %s or %s, got %q", signatureEncodingDER, signatureEncodingRaw, config.SignatureEncoding)
+	}
+
+	switch {
+	case config.KeyDeletionWindowDays == 0:
+		config.KeyDeletionWindowDays = defaultKeyDeletionWindowDays
+	case config.KeyDeletionWindowDays < minKeyDeletionWindowDays || config.KeyDeletionWindowDays > maxKeyDeletionWindowDays:
+		return nil, kmsErr.New("key deletion window must be between %d and %d days, got %d", minKeyDeletionWindowDays, maxKeyDeletionWindowDays, config.KeyDeletionWindowDays)
+	}
+
+	if config.ManagedKeys != nil {
+		if len(config.ManagedKeys) == 0 {
+			return nil, kmsErr.New("managed keys can't be empty")
+		}
+		for spireKeyID, keyARN := range config.ManagedKeys {
+			if !isKeyARN(keyARN) {
+				return nil, kmsErr.New("managed key %q must be the ARN of a KMS key, got %q", spireKeyID, keyARN)
+			}
+			if arnPartition(keyARN) != partition {
+				return nil, kmsErr.New("managed key %q (%s) is not in the %s partition of region %q", spireKeyID, keyARN, partition, config.Region)
+			}
+		}
+	}
+
+	if config.DefaultKeySpec != "" {
+		if _, err := keyTypeFromKeySpec(config.DefaultKeySpec); err != nil {
+			return nil, kmsErr.New("invalid default key spec: %v", err)
+		}
+	}
+	for spireKeyID, keySpec := range config.KeySpecs {
+		if _, err := keyTypeFromKeySpec(keySpec); err != nil {
+			return nil, kmsErr.New("invalid key spec for key %q: %v", spireKeyID, err)
+		}
+	}
+
+	// The policy is loaded here so that a missing file or a malformed
+	// document is reported before any key is created
+	if config.KeyPolicy != "" {
+		keyPolicy, err := loadKeyPolicy(config.KeyPolicy)
+		if err != nil {
+			return nil, err
+		}
+		config.KeyPolicy = keyPolicy
+	}
+
 	return config, nil
 }
 
+// signingAlgorithmForKMS returns the KMS signing algorithm for the hash
+// algorithm of the signer opts, which must be compatible with the key type
 func signingAlgorithmForKMS(keyType keymanager.KeyType, signerOpts interface{}) (string, error) {
 	var (
 		hashAlgo keymanager.HashAlgorithm
@@ -437,7 +2059,7 @@ func signingAlgorithmForKMS(keyType keymanager.KeyType, signerOpts interface{})
 		isPSS = true
 		// opts.PssOptions.SaltLength is handled by KMS. The salt length matches the bits of the hashing algorithm.
 	default:
-		return "", kmsErr.New("unsupported signer opts type %T", opts)
+		return "", kmsErr.New("%w type %T", ErrUnsupportedSignerOpts, opts)
 	}
 
 	isRSA := keyType == keymanager.KeyType_RSA_2048 || keyType == keymanager.KeyType_RSA_4096
@@ -445,9 +2067,9 @@ func signingAlgorithmForKMS(keyType keymanager.KeyType, signerOpts interface{})
 	switch {
 	case hashAlgo == keymanager.HashAlgorithm_UNSPECIFIED_HASH_ALGORITHM:
 		return "", kmsErr.New("hash algorithm is required")
-	case keyType == keymanager.KeyType_EC_P256 && hashAlgo == keymanager.HashAlgorithm_SHA256:
+	case keyType == keymanager.KeyType_EC_P256 && !isPSS && hashAlgo == keymanager.HashAlgorithm_SHA256:
 		return kms.SigningAlgorithmSpecEcdsaSha256, nil
-	case keyType == keymanager.KeyType_EC_P384 && hashAlgo == keymanager.HashAlgorithm_SHA384:
+	case keyType == keymanager.KeyType_EC_P384 && !isPSS && hashAlgo == keymanager.HashAlgorithm_SHA384:
 		return kms.SigningAlgorithmSpecEcdsaSha384, nil
 	case isRSA && !isPSS && hashAlgo == keymanager.HashAlgorithm_SHA256:
 		return kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256, nil
@@ -466,6 +2088,108 @@ func signingAlgorithmForKMS(keyType keymanager.KeyType, signerOpts interface{})
 	}
 }
 
+// checkSigningAlgorithm fails when KMS doesn't support signingAlgo for the key
+// of the entry, so that a mismatch with the key spec is caught before calling
+// KMS
+func checkSigningAlgorithm(spireKeyID string, entry keyEntry, signingAlgo string) error {
+	if len(entry.SigningAlgorithms) == 0 {
+		return nil
+	}
+	for _, supported := range entry.SigningAlgorithms {
+		if supported == signingAlgo {
+			return nil
+		}
+	}
+	return kmsErr.New("signing algorithm %s is not supported by key %q, which supports %s", signingAlgo, spireKeyID, strings.Join(entry.SigningAlgorithms, ", "))
+}
+
+// checkKeyUsage returns an error unless keyUsage is the usage of SPIRE keys
+func checkKeyUsage(keyUsage string) error {
+	if keyUsage != spireKeyUsage {
+		return fmt.Errorf("key usage must be %s, got %q", spireKeyUsage, keyUsage)
+	}
+	return nil
+}
+
+func hashForSigningAlgorithm(signingAlgo string) crypto.Hash {
+	switch signingAlgo {
+	case kms.SigningAlgorithmSpecEcdsaSha256, kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256, kms.SigningAlgorithmSpecRsassaPssSha256:
+		return crypto.SHA256
+	case kms.SigningAlgorithmSpecEcdsaSha384, kms.SigningAlgorithmSpecRsassaPkcs1V15Sha384, kms.SigningAlgorithmSpecRsassaPssSha384:
+		return crypto.SHA384
+	default:
+		return crypto.SHA512
+	}
+}
+
+// parsePublicKey parses the public key returned by KMS, so that an entry is
+// never created for a key that can't be used
+func parsePublicKey(spireKeyID string, pkixData []byte) (crypto.PublicKey, error) {
+	publicKey, err := x509.ParsePKIXPublicKey(pkixData)
+	if err != nil {
+		return nil, kmsErr.New("failed to parse public key for key %q: %v", spireKeyID, err)
+	}
+	switch publicKey.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+		return publicKey, nil
+	default:
+		return nil, kmsErr.New("unsupported public key type %T for key %q", publicKey, spireKeyID)
+	}
+}
+
+// verifySignature checks the signature of digest made with signingAlgo
+// against the public key
+func verifySignature(publicKey crypto.PublicKey, signingAlgo string, digest, signature []byte) error {
+	hash := hashForSigningAlgorithm(signingAlgo)
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest, signature) {
+			return errors.New("ECDSA verification failed")
+		}
+		return nil
+	case *rsa.PublicKey:
+		switch signingAlgo {
+		case kms.SigningAlgorithmSpecRsassaPssSha256, kms.SigningAlgorithmSpecRsassaPssSha384, kms.SigningAlgorithmSpecRsassaPssSha512:
+			return rsa.VerifyPSS(key, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		default:
+			return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// rawECDSASignature re-encodes an ASN.1 DER ECDSA signature, as returned by
+// KMS, as the concatenation of r and s, each padded to the size of the curve
+func rawECDSASignature(publicKey *ecdsa.PublicKey, der []byte) ([]byte, error) {
+	var sig struct{ R, S *big.Int }
+	rest, err := asn1.Unmarshal(der, &sig)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("trailing data after ECDSA signature")
+	}
+
+	size := (publicKey.Curve.Params().BitSize + 7) / 8
+	if sig.R.Sign() <= 0 || sig.S.Sign() <= 0 || sig.R.BitLen() > size*8 || sig.S.BitLen() > size*8 {
+		return nil, errors.New("ECDSA signature values are out of range")
+	}
+	raw := make([]byte, 2*size)
+	sig.R.FillBytes(raw[:size])
+	sig.S.FillBytes(raw[size:])
+	return raw, nil
+}
+
+// supportedKeySpecs are the key specs keyTypeFromKeySpec knows, as listed in
+// its errors
+var supportedKeySpecs = []string{
+	kms.CustomerMasterKeySpecEccNistP256,
+	kms.CustomerMasterKeySpecEccNistP384,
+	kms.CustomerMasterKeySpecRsa2048,
+	kms.CustomerMasterKeySpecRsa4096,
+}
+
 func keyTypeFromKeySpec(keySpec string) (keymanager.KeyType, error) {
 	switch keySpec {
 	case kms.CustomerMasterKeySpecRsa2048:
@@ -477,7 +2201,7 @@ func keyTypeFromKeySpec(keySpec string) (keymanager.KeyType, error) {
 	case kms.CustomerMasterKeySpecEccNistP384:
 		return keymanager.KeyType_EC_P384, nil
 	default:
-		return keymanager.KeyType_UNSPECIFIED_KEY_TYPE, fmt.Errorf("unsupported key spec: %v", keySpec)
+		return keymanager.KeyType_UNSPECIFIED_KEY_TYPE, fmt.Errorf("unsupported key spec %q, must be one of %s", keySpec, strings.Join(supportedKeySpecs, ", "))
 	}
 
 }
@@ -485,7 +2209,7 @@ func keyTypeFromKeySpec(keySpec string) (keymanager.KeyType, error) {
 func keySpecFromKeyType(keyType keymanager.KeyType) (string, error) {
 	switch keyType {
 	case keymanager.KeyType_RSA_1024:
-		return "", kmsErr.New("unsupported key type: KeyType_RSA_1024")
+		return "", kmsErr.New("key type %v is not supported by AWS KMS", keyType)
 	case keymanager.KeyType_RSA_2048:
 		return kms.CustomerMasterKeySpecRsa2048, nil
 	case keymanager.KeyType_RSA_4096:
@@ -494,9 +2218,66 @@ func keySpecFromKeyType(keyType keymanager.KeyType) (string, error) {
 		return kms.CustomerMasterKeySpecEccNistP256, nil
 	case keymanager.KeyType_EC_P384:
 		return kms.CustomerMasterKeySpecEccNistP384, nil
+	case keymanager.KeyType_UNSPECIFIED_KEY_TYPE:
+		return "", kmsErr.New("key type is required")
 	default:
-		return "", kmsErr.New("unknown key type")
+		return "", kmsErr.New("unknown key type %v", keyType)
+	}
+}
+
+// withDeniedAction names the KMS action and the key in AccessDenied errors,
+// which otherwise don't tell the operator what permission is missing. Other
+// errors are only wrapped by wrapAWSErr. AWS errors are then classified by
+// classifyError.
+func withDeniedAction(err error, action, kmsKeyID string) error {
+	err = wrapAWSErr(action, err)
+	if !isAWSErrorCode(err, accessDeniedErrCode) {
+		return classifyError(err)
+	}
+	if kmsKeyID == "" {
+		return classifyError(fmt.Errorf("permission %s is missing: %w", action, err))
+	}
+	return classifyError(fmt.Errorf("permission %s is missing for key %q: %w", action, kmsKeyID, err))
+}
+
+// requestError is a failed AWS request, formatted on a single line with the
+// request id and status code, so that the call can be found in CloudTrail or
+// quoted in a support case. It is still an awserr.RequestFailure.
+type requestError struct {
+	awserr.RequestFailure
+	op string
+}
+
+func (e requestError) Error() string {
+	msg := fmt.Sprintf("%s: %s (operation: %s, status code: %d, request id: %s)", e.Code(), e.Message(), e.op, e.StatusCode(), e.RequestID())
+	if origErr := e.OrigErr(); origErr != nil {
+		msg += fmt.Sprintf(", caused by: %v", origErr)
+	}
+	return msg
+}
+
+func (e requestError) Unwrap() error {
+	return e.RequestFailure
+}
+
+// wrapAWSErr adds the request id and status code of a failed AWS request
+// made by op (e.g. kms:Sign) to its error. Other errors are returned as is.
+func wrapAWSErr(op string, err error) error {
+	if _, ok := err.(requestError); ok {
+		return err
+	}
+	reqErr, ok := err.(awserr.RequestFailure)
+	if !ok || reqErr.RequestID() == "" {
+		return err
+	}
+	return requestError{RequestFailure: reqErr, op: op}
+}
+
+func isAWSErrorCode(err error, code string) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == code
 	}
+	return false
 }
 
 func clonePublicKey(publicKey *keymanager.PublicKey) *keymanager.PublicKey {
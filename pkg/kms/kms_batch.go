@@ -0,0 +1,66 @@
+package kms
+
+import (
+	"context"
+	"sync"
+
+	"github.com/spiffe/spire/proto/spire/server/keymanager"
+)
+
+// GenerateKeyResult is the outcome of one of the requests of GenerateKeys
+type GenerateKeyResult struct {
+	KeyID     string
+	PublicKey *keymanager.PublicKey
+	Err       error
+}
+
+// GenerateKeys generates several keys at once, e.g. when provisioning the keys
+// of a new server, with up to generateKeysConcurrency keys created at once.
+// Each key is generated like with GenerateKey, and a failing key doesn't stop
+// the others: the results are returned in the order of the requests, each with
+// its own error. Nil requests fail, and the keys not started yet when ctx is
+// done fail with its error.
+func (p *Plugin) GenerateKeys(ctx context.Context, reqs []*keymanager.GenerateKeyRequest) []GenerateKeyResult {
+	results := make([]GenerateKeyResult, len(reqs))
+	sem := make(chan struct{}, generateKeysConcurrency)
+
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		i, req := i, req
+		if req == nil {
+			results[i].Err = kmsErr.New("request is nil")
+			continue
+		}
+		results[i].KeyID = req.KeyId
+		// A free slot is not taken once ctx is done
+		err := ctx.Err()
+		if err == nil {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+		if err != nil {
+			results[i].Err = kmsErr.New("key %q not generated: %w", req.KeyId, err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			resp, err := p.GenerateKey(ctx, req)
+			if err != nil {
+				results[i].Err = err
+				return
+			}
+			results[i].PublicKey = resp.PublicKey
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
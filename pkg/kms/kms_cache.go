@@ -0,0 +1,76 @@
+package kms
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// describeCache holds the metadata of described keys for a short time, so
+// that a refresh right after another one doesn't describe every key again.
+// A zero TTL disables it.
+type describeCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]describeCacheEntry
+
+	now func() time.Time
+}
+
+type describeCacheEntry struct {
+	metadata *kms.KeyMetadata
+	expires  time.Time
+}
+
+func newDescribeCache(ttl time.Duration) *describeCache {
+	return &describeCache{
+		ttl:     ttl,
+		entries: make(map[string]describeCacheEntry),
+		now:     time.Now,
+	}
+}
+
+// get returns the metadata of the key with the given id, unless it was not
+// cached or has expired
+func (c *describeCache) get(keyID string) (*kms.KeyMetadata, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[keyID]
+	if !ok || !c.now().Before(entry.expires) {
+		return nil, false
+	}
+	return entry.metadata, true
+}
+
+// put caches the metadata of the key with the given id, and drops the
+// expired entries
+func (c *describeCache) put(keyID string, metadata *kms.KeyMetadata) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for id, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, id)
+		}
+	}
+	c.entries[keyID] = describeCacheEntry{
+		metadata: metadata,
+		expires:  now.Add(c.ttl),
+	}
+}
+
+// forget drops the metadata of the key with the given id, e.g. because its
+// state was changed
+func (c *describeCache) forget(keyID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, keyID)
+}
@@ -0,0 +1,174 @@
+package kms
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/spiffe/spire/proto/spire/server/keymanager"
+)
+
+// cacheFile is the content of the file at cache_path. It is only used for
+// the region and key prefix it was written with.
+type cacheFile struct {
+	Region    string           `json:"region"`
+	KeyPrefix string           `json:"key_prefix"`
+	Entries   []cacheFileEntry `json:"entries"`
+}
+
+type cacheFileEntry struct {
+	SpireKeyID   string             `json:"spire_key_id"`
+	KMSKeyID     string             `json:"kms_key_id"`
+	Alias        string             `json:"alias"`
+	KeyType      keymanager.KeyType `json:"key_type"`
+	CreationDate time.Time          `json:"creation_date"`
+	PublicKey    []byte             `json:"public_key"`
+	// SigningAlgorithms is missing from the files of older versions
+	SigningAlgorithms []string `json:"signing_algorithms,omitempty"`
+}
+
+// loadCacheFile sets the entries from the cache file, instead of discovering
+// the keys in KMS. It returns false, leaving the entries untouched, when there
+// is no usable cache file.
+func (p *Plugin) loadCacheFile() (bool, error) {
+	data, err := ioutil.ReadFile(p.cachePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, kmsErr.New("failed to read cache file: %v", err)
+	}
+
+	var file cacheFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return false, kmsErr.New("failed to parse cache file: %v", err)
+	}
+	if file.Region != p.region || file.KeyPrefix != p.keyPrefix {
+		p.log.Info("Ignored cache file written with another configuration", "path", p.cachePath)
+		return false, nil
+	}
+
+	entries := make(map[string]keyEntry)
+	for _, cached := range file.Entries {
+		parsedPublicKey, err := parsePublicKey(cached.SpireKeyID, cached.PublicKey)
+		if err != nil {
+			return false, err
+		}
+		entry := keyEntry{
+			KMSKeyID:     cached.KMSKeyID,
+			Alias:        cached.Alias,
+			CreationDate: cached.CreationDate,
+			LoadedAt:     time.Now(),
+			PublicKey: &keymanager.PublicKey{
+				Id:       cached.SpireKeyID,
+				Type:     cached.KeyType,
+				PkixData: cached.PublicKey,
+			},
+			ParsedPublicKey:   parsedPublicKey,
+			SigningAlgorithms: cached.SigningAlgorithms,
+			Cached:            true,
+		}
+		if err := validateEntry(cached.SpireKeyID, entry); err != nil {
+			return false, err
+		}
+		entries[cached.SpireKeyID] = entry
+	}
+
+	p.mu.Lock()
+	p.entries = entries
+	p.reportEntryCount()
+	p.mu.Unlock()
+
+	p.log.Info("Loaded keys from cache file", "path", p.cachePath, "count", len(entries))
+	return true, nil
+}
+
+// saveCacheFile writes the entries to the cache file, if configured. Failures
+// are only logged: the keys are discovered in KMS without the file.
+func (p *Plugin) saveCacheFile() {
+	if p.cachePath == "" {
+		return
+	}
+
+	// Saves are serialized, so that an older snapshot can't overwrite a
+	// newer one
+	p.cacheFileMu.Lock()
+	defer p.cacheFileMu.Unlock()
+
+	file := cacheFile{
+		Region:    p.region,
+		KeyPrefix: p.keyPrefix,
+	}
+	p.mu.RLock()
+	for spireKeyID, entry := range p.entries {
+		file.Entries = append(file.Entries, cacheFileEntry{
+			SpireKeyID:        spireKeyID,
+			KMSKeyID:          entry.KMSKeyID,
+			Alias:             entry.Alias,
+			KeyType:           entry.PublicKey.Type,
+			CreationDate:      entry.CreationDate,
+			PublicKey:         entry.PublicKey.PkixData,
+			SigningAlgorithms: entry.SigningAlgorithms,
+		})
+	}
+	p.mu.RUnlock()
+
+	if err := writeCacheFile(p.cachePath, file); err != nil {
+		p.log.Warn("Failed to save cache file", "error", err, "path", p.cachePath)
+	}
+}
+
+// writeCacheFile replaces the file at path through a rename, so that a
+// crash doesn't leave a truncated file behind
+func writeCacheFile(path string, file cacheFile) error {
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// verifyCachedEntry checks that the key of an entry loaded from the cache
+// file still exists and is enabled, the first time the entry is used. The
+// entry is evicted when its key is gone.
+func (p *Plugin) verifyCachedEntry(ctx context.Context, spireKeyID string, entry keyEntry) (keyEntry, error) {
+	metadata, err := p.describeKey(ctx, entry.KMSKeyID)
+	switch {
+	case isAWSErrorCode(err, kms.ErrCodeNotFoundException):
+	case err != nil:
+		return keyEntry{}, kmsErr.New("failed to describe key %q: %w", spireKeyID, withDeniedAction(err, "kms:DescribeKey", entry.KMSKeyID))
+	case aws.StringValue(metadata.KeyState) == kms.KeyStateEnabled:
+		entry.Cached = false
+		entry.SigningAlgorithms = aws.StringValueSlice(metadata.SigningAlgorithms)
+		p.mu.Lock()
+		if current, ok := p.entries[spireKeyID]; ok && current.KMSKeyID == entry.KMSKeyID {
+			p.entries[spireKeyID] = entry
+		}
+		p.mu.Unlock()
+		return entry, nil
+	}
+
+	p.evictEntry(spireKeyID, entry.KMSKeyID)
+	p.saveCacheFile()
+	p.log.Warn("Evicted cached key that is no longer usable in KMS", spireKeyIDTag, spireKeyID, keyIDTag, entry.KMSKeyID)
+	return keyEntry{}, kmsErr.New("no such key %q", spireKeyID)
+}
@@ -0,0 +1,131 @@
+package kms
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/hashicorp/go-hclog"
+	"github.com/spiffe/spire/pkg/server/plugin/keymanager"
+	"github.com/spiffe/spire/proto/spire/common/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kms-cache-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cachePath := filepath.Join(dir, "keys.json")
+
+	fake := newKMSClientFake(t)
+	fake.setEntries([]fakeKeyEntry{
+		{
+			KeyID:     kmsKeyID,
+			AliasName: spireKeyAlias,
+			KeySpec:   kms.CustomerMasterKeySpecEccNistP256,
+		},
+	})
+
+	var saved *cacheFile
+	t.Run("missing cache file", func(t *testing.T) {
+		p := newCacheFileTestPlugin(t, fake, cachePath)
+
+		entry, ok := p.entry(spireKeyID)
+		require.True(t, ok)
+		require.False(t, entry.Cached)
+
+		// The discovered keys were saved
+		file := readCacheFile(t, cachePath)
+		require.Equal(t, validRegion, file.Region)
+		require.Len(t, file.Entries, 1)
+		require.Equal(t, spireKeyID, file.Entries[0].SpireKeyID)
+		require.Equal(t, kmsKeyID, file.Entries[0].KMSKeyID)
+		require.Equal(t, entry.PublicKey.PkixData, file.Entries[0].PublicKey)
+		saved = file
+	})
+
+	t.Run("cache hit", func(t *testing.T) {
+		// Discovery would fail, so the keys can only come from the file
+		fake.listAliasesErr = errors.New("list aliases error")
+		defer func() { fake.listAliasesErr = nil }()
+
+		p := newCacheFileTestPlugin(t, fake, cachePath)
+		entry, ok := p.entry(spireKeyID)
+		require.True(t, ok)
+		require.True(t, entry.Cached)
+
+		// The key is verified when first used
+		_, err := p.SignData(ctx, &keymanager.SignDataRequest{
+			KeyId:      spireKeyID,
+			Data:       digest(crypto.SHA256, []byte("data")),
+			SignerOpts: hashAlgorithmOpts(keymanager.HashAlgorithm_SHA256),
+		})
+		require.NoError(t, err)
+		entry, ok = p.entry(spireKeyID)
+		require.True(t, ok)
+		require.False(t, entry.Cached)
+	})
+
+	t.Run("stale cache", func(t *testing.T) {
+		p := newCacheFileTestPlugin(t, fake, cachePath)
+
+		// The key was deleted while the server was down
+		_, err := fake.ScheduleKeyDeletionWithContext(ctx, &kms.ScheduleKeyDeletionInput{KeyId: aws.String(kmsKeyID)})
+		require.NoError(t, err)
+
+		_, err = p.GetPublicKey(ctx, &keymanager.GetPublicKeyRequest{KeyId: spireKeyID})
+		require.EqualError(t, err, `kms: no such key "spireKeyID"`)
+		_, ok := p.entry(spireKeyID)
+		require.False(t, ok)
+		require.Empty(t, readCacheFile(t, cachePath).Entries)
+	})
+
+	t.Run("unusable cache file", func(t *testing.T) {
+		require.NoError(t, ioutil.WriteFile(cachePath, []byte("not json"), 0600))
+
+		p := newCacheFileTestPlugin(t, fake, cachePath)
+		_, ok := p.entry(spireKeyID)
+		require.False(t, ok)
+		require.NotNil(t, readCacheFile(t, cachePath))
+	})
+
+	t.Run("cache file of another region", func(t *testing.T) {
+		// The deleted key would be loaded from a file of the same region
+		file := *saved
+		file.Region = "eu-west-1"
+		data, err := json.Marshal(file)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(cachePath, data, 0600))
+
+		p := newCacheFileTestPlugin(t, fake, cachePath)
+		_, ok := p.entry(spireKeyID)
+		require.False(t, ok)
+	})
+}
+
+func newCacheFileTestPlugin(t *testing.T, fake *kmsClientFake, cachePath string) *Plugin {
+	p := newPlugin(func(c *Config) (kmsClient, error) {
+		return fake, nil
+	})
+	p.SetLogger(hclog.NewNullLogger())
+	_, err := p.Configure(ctx, &plugin.ConfigureRequest{
+		Configuration: fmt.Sprintf(`{"region": "%s", "key_policy": "{}", "cache_path": %q}`, validRegion, cachePath),
+	})
+	require.NoError(t, err)
+	return p
+}
+
+func readCacheFile(t *testing.T, path string) *cacheFile {
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	file := new(cacheFile)
+	require.NoError(t, json.Unmarshal(data, file))
+	return file
+}
@@ -1,36 +1,311 @@
 package kms
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Values of credential_source
+const (
+	credentialSourceStatic      = "static"
+	credentialSourceEnvironment = "environment"
+	credentialSourceInstance    = "instance"
+	credentialSourceDefault     = "default"
 )
 
+// kmsClient is the subset of the KMS API used by the plugin. It allows the
+// concrete client to be replaced by a fake in tests (see Plugin.hooks).
 type kmsClient interface {
+	CreateGrantWithContext(aws.Context, *kms.CreateGrantInput, ...request.Option) (*kms.CreateGrantOutput, error)
 	CreateKeyWithContext(aws.Context, *kms.CreateKeyInput, ...request.Option) (*kms.CreateKeyOutput, error)
 	DescribeKeyWithContext(aws.Context, *kms.DescribeKeyInput, ...request.Option) (*kms.DescribeKeyOutput, error)
+	DisableKeyWithContext(aws.Context, *kms.DisableKeyInput, ...request.Option) (*kms.DisableKeyOutput, error)
+	EnableKeyWithContext(aws.Context, *kms.EnableKeyInput, ...request.Option) (*kms.EnableKeyOutput, error)
 	CreateAliasWithContext(aws.Context, *kms.CreateAliasInput, ...request.Option) (*kms.CreateAliasOutput, error)
 	UpdateAliasWithContext(aws.Context, *kms.UpdateAliasInput, ...request.Option) (*kms.UpdateAliasOutput, error)
+	DeleteAliasWithContext(aws.Context, *kms.DeleteAliasInput, ...request.Option) (*kms.DeleteAliasOutput, error)
 	GetPublicKeyWithContext(aws.Context, *kms.GetPublicKeyInput, ...request.Option) (*kms.GetPublicKeyOutput, error)
 	ListAliasesWithContext(aws.Context, *kms.ListAliasesInput, ...request.Option) (*kms.ListAliasesOutput, error)
+	ListKeysWithContext(aws.Context, *kms.ListKeysInput, ...request.Option) (*kms.ListKeysOutput, error)
+	ListResourceTagsWithContext(aws.Context, *kms.ListResourceTagsInput, ...request.Option) (*kms.ListResourceTagsOutput, error)
+	RetireGrantWithContext(aws.Context, *kms.RetireGrantInput, ...request.Option) (*kms.RetireGrantOutput, error)
 	ScheduleKeyDeletionWithContext(aws.Context, *kms.ScheduleKeyDeletionInput, ...request.Option) (*kms.ScheduleKeyDeletionOutput, error)
 	SignWithContext(aws.Context, *kms.SignInput, ...request.Option) (*kms.SignOutput, error)
+	TagResourceWithContext(aws.Context, *kms.TagResourceInput, ...request.Option) (*kms.TagResourceOutput, error)
 }
 
+var _ kmsClient = (*kms.KMS)(nil)
+
+// KMSClient is the subset of the KMS API used by the plugin, implemented by
+// *kms.KMS. It is exported for WithKMSClient.
+type KMSClient = kmsClient
+
+// stsClient is the subset of the STS API used by the plugin, to find out the
+// principal it runs as.
+type stsClient interface {
+	GetCallerIdentityWithContext(aws.Context, *sts.GetCallerIdentityInput, ...request.Option) (*sts.GetCallerIdentityOutput, error)
+}
+
+var _ stsClient = (*sts.STS)(nil)
+
+// STSClient is the subset of the STS API used by the plugin, implemented by
+// *sts.STS. It is exported for WithSTSClient.
+type STSClient = stsClient
+
 func newKMSClient(c *Config) (kmsClient, error) {
+	s, err := newSession(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return kms.New(s, newKMSConfig(c, s)), nil
+}
+
+func newSTSClient(c *Config) (stsClient, error) {
+	s, err := newSession(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return sts.New(s), nil
+}
+
+// newSession returns the session the clients are created from. A configured
+// web identity replaces the default credential chain, e.g. to pin the role
+// and token file of EKS IAM roles for service accounts.
+func newSession(c *Config) (*session.Session, error) {
+	opts, err := newSessionOptions(c)
+	if err != nil {
+		return nil, err
+	}
+	s, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if provider := newWebIdentityRoleProvider(c, s); provider != nil {
+		s.Config.Credentials = credentials.NewCredentials(provider)
+	}
+	if provider := newCredentialSourceProvider(c, s); provider != nil {
+		s.Config.Credentials = credentials.NewCredentials(provider)
+	}
+	return s, nil
+}
+
+// newCredentialSourceProvider returns the provider of the configured
+// credential source, or nil when the credentials are left to newAWSConfig and
+// the SDK credential chain. The environment and instance sources only use
+// their provider, e.g. so that an instance profile isn't used when the
+// environment variables are missing.
+func newCredentialSourceProvider(c *Config, s *session.Session) credentials.Provider {
+	switch c.CredentialSource {
+	case credentialSourceStatic:
+		return &credentials.StaticProvider{Value: credentials.Value{
+			AccessKeyID:     c.AccessKeyID,
+			SecretAccessKey: c.SecretAccessKey,
+		}}
+	case credentialSourceEnvironment:
+		return &credentials.EnvProvider{}
+	case credentialSourceInstance:
+		return &ec2rolecreds.EC2RoleProvider{Client: ec2metadata.New(s)}
+	default:
+		return nil
+	}
+}
+
+// newKMSConfig returns the configuration specific to the KMS client. The
+// endpoint override only applies to KMS, so that STS is still reached on its
+// regular endpoint when a role is assumed.
+func newKMSConfig(c *Config, s *session.Session) *aws.Config {
+	// Throttled and transient calls are retried by the plugin (see
+	// retryClient), so max_retries is the only retry limit.
+	kmsConfig := &aws.Config{
+		MaxRetries: aws.Int(0),
+	}
+	if c.KMSEndpoint != "" {
+		kmsConfig.Endpoint = aws.String(c.KMSEndpoint)
+	}
+	if c.UseFIPSEndpoint {
+		// The region was validated along with the rest of the configuration
+		endpoint, _ := fipsEndpoint(c.Region)
+		kmsConfig.Endpoint = aws.String(endpoint)
+	}
+
+	// When a role is configured, the session credentials (static or from the
+	// default chain) are only used to assume it, and KMS is called with the
+	// credentials of the assumed role.
+	if provider := newAssumeRoleProvider(c, s); provider != nil {
+		kmsConfig.Credentials = credentials.NewCredentials(provider)
+	}
+
+	return kmsConfig
+}
+
+// fipsEndpoint returns the FIPS 140-2 validated KMS endpoint of the region,
+// e.g. https://kms-fips.us-east-1.amazonaws.com. The SDK does not resolve
+// FIPS endpoints itself, so it is derived from the regular one. Only the aws
+// and aws-us-gov partitions have them.
+func fipsEndpoint(region string) (string, error) {
+	partition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region)
+	if !ok || !partitionHasFIPSEndpoints(partition.ID()) {
+		return "", fmt.Errorf("no FIPS endpoint in region %q", region)
+	}
+
+	resolved, err := partition.EndpointFor(kms.EndpointsID, region)
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(resolved.URL, "://kms.", "://kms-fips.", 1), nil
+}
+
+// newSessionOptions returns the options of the session. When a profile is
+// configured, it is loaded from the shared config and credentials files
+// (~/.aws/config and ~/.aws/credentials), while the region and endpoints of
+// the plugin configuration still take precedence.
+func newSessionOptions(c *Config) (session.Options, error) {
+	opts := session.Options{
+		Config: *newAWSConfig(c),
+	}
+	if c.Profile != "" {
+		opts.Profile = c.Profile
+		opts.SharedConfigState = session.SharedConfigEnable
+	}
+
+	httpClient, err := newHTTPClient(c)
+	if err != nil {
+		return session.Options{}, err
+	}
+	opts.Config.HTTPClient = httpClient
+	return opts, nil
+}
+
+// newHTTPClient returns the HTTP client AWS is called with, e.g. through a
+// proxy and trusting a private CA. It returns nil, for the default client of
+// the SDK, when neither is configured.
+func newHTTPClient(c *Config) (*http.Client, error) {
+	if c.HTTPProxy == "" && c.CABundlePath == "" {
+		return nil, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.HTTPProxy != "" {
+		proxyURL, err := parseProxyURL(c.HTTPProxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if c.CABundlePath != "" {
+		// Like AWS_CA_BUNDLE, the bundle replaces the system roots
+		pemCerts, err := ioutil.ReadFile(c.CABundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %q", c.CABundlePath)
+		}
+		transport.TLSClientConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			RootCAs:    roots,
+		}
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// parseProxyURL parses the URL of an HTTP proxy, e.g. http://proxy:3128
+func parseProxyURL(proxy string) (*url.URL, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if (proxyURL.Scheme != "http" && proxyURL.Scheme != "https") || proxyURL.Host == "" {
+		return nil, fmt.Errorf("%q is not an http or https URL", proxy)
+	}
+	return proxyURL, nil
+}
+
+func partitionHasFIPSEndpoints(partitionID string) bool {
+	return partitionID == endpoints.AwsPartitionID || partitionID == endpoints.AwsUsGovPartitionID
+}
+
+// partitionForRegion returns the id of the partition of the region, e.g.
+// aws-us-gov for us-gov-west-1
+func partitionForRegion(region string) (string, bool) {
+	partition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region)
+	if !ok {
+		return "", false
+	}
+	return partition.ID(), true
+}
+
+// arnPartition returns the partition of an ARN, e.g. aws-cn for
+// arn:aws-cn:iam::123456789012:role/spire-server
+func arnPartition(arn string) string {
+	parts := strings.SplitN(arn, ":", 3)
+	if len(parts) < 3 || parts[0] != "arn" {
+		return ""
+	}
+	return parts[1]
+}
+
+// newAWSConfig returns the session configuration. Static credentials are only
+// set when both keys are configured; otherwise the SDK falls back to its
+// default credential chain (environment, shared config, web identity, EC2
+// instance profile, ...).
+func newAWSConfig(c *Config) *aws.Config {
 	awsConfig := &aws.Config{
 		Region: aws.String(c.Region),
+		// STS is called in the region, like KMS. The global endpoint only
+		// exists in the aws partition, and only signs for us-east-1.
+		STSRegionalEndpoint: endpoints.RegionalSTSEndpoint,
 	}
 	if c.SecretAccessKey != "" && c.AccessKeyID != "" {
 		awsConfig.Credentials = credentials.NewStaticCredentials(c.AccessKeyID, c.SecretAccessKey, "")
 	}
 
-	s, err := session.NewSession(awsConfig)
-	if err != nil {
-		return nil, err
+	return awsConfig
+}
+
+// newWebIdentityRoleProvider returns a provider for the credentials of the
+// configured web identity role, or nil if none is configured. The token file
+// is read again whenever the credentials expire, so it can be rotated.
+func newWebIdentityRoleProvider(c *Config, s *session.Session) *stscreds.WebIdentityRoleProvider {
+	if c.WebIdentityRoleARN == "" {
+		return nil
 	}
 
-	return kms.New(s), nil
+	return stscreds.NewWebIdentityRoleProvider(sts.New(s), c.WebIdentityRoleARN, "", c.WebIdentityTokenFile)
+}
+
+// newAssumeRoleProvider returns a provider for the credentials of the
+// configured role, or nil if no role has to be assumed.
+func newAssumeRoleProvider(c *Config, s *session.Session) *stscreds.AssumeRoleProvider {
+	if c.AssumeRoleARN == "" {
+		return nil
+	}
+
+	return &stscreds.AssumeRoleProvider{
+		Client:          sts.New(s),
+		RoleARN:         c.AssumeRoleARN,
+		RoleSessionName: c.RoleSessionName,
+		Duration:        stscreds.DefaultDuration,
+	}
 }
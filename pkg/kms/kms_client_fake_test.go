@@ -0,0 +1,915 @@
+package kms
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers the SHA-256 hash used to sign raw messages
+	_ "crypto/sha512" // registers the SHA-384/512 hashes used to sign raw messages
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	fakeAccountID = "123456789012"
+	fakeRegion    = "us-west-2"
+)
+
+var (
+	// Generating RSA keys is slow, so key material is generated once per key
+	// spec and shared by every fake key of that spec.
+	fakeKeysMu sync.Mutex
+	fakeKeys   = make(map[string]crypto.Signer)
+)
+
+// fakeKeyEntry describes a key stored in the fake KMS. Tests use it to seed
+// the fake through setEntries.
+type fakeKeyEntry struct {
+	KeyID        string
+	AliasName    string
+	Description  string
+	KeySpec      string
+	KeyUsage     string
+	KeyState     string
+	CreationDate time.Time
+	Tags         map[string]string
+	Policy       string
+
+	// PendingWindowInDays is the waiting period requested when the key was
+	// scheduled for deletion
+	PendingWindowInDays int64
+
+	// NoCreationDate makes the metadata of the key lack a creation date
+	NoCreationDate bool
+
+	// SigningAlgorithms replaces the signing algorithms of the key spec in
+	// the metadata of the key
+	SigningAlgorithms []string
+
+	// Grants holds the grants of the key, by grant id
+	Grants map[string]fakeGrant
+
+	privateKey crypto.Signer
+	publicKey  []byte
+}
+
+type fakeGrant struct {
+	GranteePrincipal  string
+	RetiringPrincipal string
+	Operations        []string
+}
+
+// kmsClientFake is an in-memory implementation of kmsClient. Keys are stored
+// in a map and backed by real key material, so public keys are valid PKIX
+// data and signatures can be verified.
+type kmsClientFake struct {
+	t *testing.T
+
+	mu      sync.RWMutex
+	keys    map[string]*fakeKeyEntry
+	aliases map[string]string
+	nextID  int
+
+	// pageSize limits the number of results returned per page by the list
+	// operations. Zero means everything is returned in a single page.
+	pageSize int
+
+	createGrantErr         error
+	createKeyErr           error
+	describeKeyErr         error
+	disableKeyErr          error
+	enableKeyErr           error
+	getPublicKeyErr        error
+	listAliasesErr         error
+	listKeysErr            error
+	listResourceTagsErr    error
+	retireGrantErr         error
+	scheduleKeyDeletionErr error
+	signErr                error
+	tagResourceErr         error
+	createAliasErr         error
+	updateAliasErr         error
+	deleteAliasErr         error
+
+	// getPublicKeyNotFound makes that many calls to GetPublicKey fail with
+	// NotFound, like KMS right after a key is created
+	getPublicKeyNotFound int
+
+	// tamperSignatures makes Sign return signatures that don't verify
+	tamperSignatures bool
+
+	// describeKeyCalls counts the calls to DescribeKey
+	describeKeyCalls int
+
+	// describeKeyDelay and createKeyDelay make DescribeKey and CreateKey
+	// wait before answering, and maxDescribeKeyInFlight and
+	// maxCreateKeyInFlight record how many calls were waiting at once
+	describeKeyDelay       time.Duration
+	createKeyDelay         time.Duration
+	inFlightMu             sync.Mutex
+	describeKeyInFlight    int
+	maxDescribeKeyInFlight int
+	createKeyInFlight      int
+	maxCreateKeyInFlight   int
+}
+
+func newKMSClientFake(t *testing.T) *kmsClientFake {
+	return &kmsClientFake{
+		t:       t,
+		keys:    make(map[string]*fakeKeyEntry),
+		aliases: make(map[string]string),
+	}
+}
+
+func (k *kmsClientFake) CreateKeyWithContext(ctx aws.Context, input *kms.CreateKeyInput, opts ...request.Option) (*kms.CreateKeyOutput, error) {
+	if k.createKeyErr != nil {
+		return nil, k.createKeyErr
+	}
+	if k.createKeyDelay > 0 {
+		k.waitInFlight(k.createKeyDelay, &k.createKeyInFlight, &k.maxCreateKeyInFlight)
+	}
+	if aws.StringValue(input.KeyUsage) != kms.KeyUsageTypeSignVerify {
+		return nil, awserr.New("ValidationException", fmt.Sprintf("unsupported key usage %q", aws.StringValue(input.KeyUsage)), nil)
+	}
+
+	if policy := aws.StringValue(input.Policy); policy != "" && !json.Valid([]byte(policy)) {
+		return nil, awserr.New(kms.ErrCodeMalformedPolicyDocumentException, "malformed policy document", nil)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.nextID++
+	entry := &fakeKeyEntry{
+		KeyID:        fmt.Sprintf("fake-key-%d", k.nextID),
+		Description:  aws.StringValue(input.Description),
+		KeySpec:      aws.StringValue(input.CustomerMasterKeySpec),
+		KeyUsage:     aws.StringValue(input.KeyUsage),
+		KeyState:     kms.KeyStateEnabled,
+		CreationDate: time.Now(),
+		Tags:         make(map[string]string),
+		Policy:       aws.StringValue(input.Policy),
+	}
+	for _, tag := range input.Tags {
+		entry.Tags[aws.StringValue(tag.TagKey)] = aws.StringValue(tag.TagValue)
+	}
+	if err := entry.generateKey(); err != nil {
+		return nil, err
+	}
+	k.keys[entry.KeyID] = entry
+
+	return &kms.CreateKeyOutput{KeyMetadata: entry.metadata()}, nil
+}
+
+func (k *kmsClientFake) DescribeKeyWithContext(ctx aws.Context, input *kms.DescribeKeyInput, opts ...request.Option) (*kms.DescribeKeyOutput, error) {
+	if k.describeKeyErr != nil {
+		return nil, k.describeKeyErr
+	}
+	if k.describeKeyDelay > 0 {
+		k.waitInFlight(k.describeKeyDelay, &k.describeKeyInFlight, &k.maxDescribeKeyInFlight)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.describeKeyCalls++
+	entry, err := k.resolve(input.KeyId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kms.DescribeKeyOutput{KeyMetadata: entry.metadata()}, nil
+}
+
+func (k *kmsClientFake) GetPublicKeyWithContext(ctx aws.Context, input *kms.GetPublicKeyInput, opts ...request.Option) (*kms.GetPublicKeyOutput, error) {
+	if k.getPublicKeyErr != nil {
+		return nil, k.getPublicKeyErr
+	}
+
+	k.mu.Lock()
+	if k.getPublicKeyNotFound > 0 {
+		k.getPublicKeyNotFound--
+		k.mu.Unlock()
+		return nil, awserr.New(kms.ErrCodeNotFoundException, fmt.Sprintf("key %s is not found", aws.StringValue(input.KeyId)), nil)
+	}
+	k.mu.Unlock()
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	entry, err := k.resolve(input.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	if entry.publicKey == nil {
+		return nil, awserr.New(kms.ErrCodeUnsupportedOperationException, "key has no public key", nil)
+	}
+
+	return &kms.GetPublicKeyOutput{
+		CustomerMasterKeySpec: aws.String(entry.KeySpec),
+		KeyId:                 aws.String(entry.arn()),
+		KeyUsage:              aws.String(entry.KeyUsage),
+		PublicKey:             append([]byte(nil), entry.publicKey...),
+		SigningAlgorithms:     aws.StringSlice(signingAlgorithmsForSpec(entry.KeySpec)),
+	}, nil
+}
+
+func (k *kmsClientFake) ListKeysWithContext(ctx aws.Context, input *kms.ListKeysInput, opts ...request.Option) (*kms.ListKeysOutput, error) {
+	if k.listKeysErr != nil {
+		return nil, k.listKeysErr
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	var keyIDs []string
+	for keyID := range k.keys {
+		keyIDs = append(keyIDs, keyID)
+	}
+	sort.Strings(keyIDs)
+
+	start, end, nextMarker, err := k.page(len(keyIDs), input.Marker, input.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &kms.ListKeysOutput{NextMarker: nextMarker, Truncated: aws.Bool(nextMarker != nil)}
+	for _, keyID := range keyIDs[start:end] {
+		output.Keys = append(output.Keys, &kms.KeyListEntry{
+			KeyArn: aws.String(k.keys[keyID].arn()),
+			KeyId:  aws.String(keyID),
+		})
+	}
+	return output, nil
+}
+
+func (k *kmsClientFake) ListAliasesWithContext(ctx aws.Context, input *kms.ListAliasesInput, opts ...request.Option) (*kms.ListAliasesOutput, error) {
+	if k.listAliasesErr != nil {
+		return nil, k.listAliasesErr
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	var aliasNames []string
+	for aliasName := range k.aliases {
+		aliasNames = append(aliasNames, aliasName)
+	}
+	sort.Strings(aliasNames)
+
+	start, end, nextMarker, err := k.page(len(aliasNames), input.Marker, input.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &kms.ListAliasesOutput{NextMarker: nextMarker, Truncated: aws.Bool(nextMarker != nil)}
+	for _, aliasName := range aliasNames[start:end] {
+		output.Aliases = append(output.Aliases, &kms.AliasListEntry{
+			AliasArn:    aws.String(fmt.Sprintf("arn:aws:kms:%s:%s:%s", fakeRegion, fakeAccountID, aliasName)),
+			AliasName:   aws.String(aliasName),
+			TargetKeyId: aws.String(k.aliases[aliasName]),
+		})
+	}
+	return output, nil
+}
+
+func (k *kmsClientFake) ListResourceTagsWithContext(ctx aws.Context, input *kms.ListResourceTagsInput, opts ...request.Option) (*kms.ListResourceTagsOutput, error) {
+	if k.listResourceTagsErr != nil {
+		return nil, k.listResourceTagsErr
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if strings.HasPrefix(aws.StringValue(input.KeyId), aliasPrefix) {
+		return nil, awserr.New(kms.ErrCodeInvalidArnException, "aliases are not supported", nil)
+	}
+	entry, err := k.resolve(input.KeyId)
+	if err != nil {
+		return nil, err
+	}
+
+	var tagKeys []string
+	for tagKey := range entry.Tags {
+		tagKeys = append(tagKeys, tagKey)
+	}
+	sort.Strings(tagKeys)
+
+	start, end, nextMarker, err := k.page(len(tagKeys), input.Marker, input.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &kms.ListResourceTagsOutput{NextMarker: nextMarker, Truncated: aws.Bool(nextMarker != nil)}
+	for _, tagKey := range tagKeys[start:end] {
+		output.Tags = append(output.Tags, &kms.Tag{
+			TagKey:   aws.String(tagKey),
+			TagValue: aws.String(entry.Tags[tagKey]),
+		})
+	}
+	return output, nil
+}
+
+func (k *kmsClientFake) CreateGrantWithContext(ctx aws.Context, input *kms.CreateGrantInput, opts ...request.Option) (*kms.CreateGrantOutput, error) {
+	if k.createGrantErr != nil {
+		return nil, k.createGrantErr
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	entry, err := k.resolve(input.KeyId)
+	if err != nil {
+		return nil, err
+	}
+
+	k.nextID++
+	grantID := fmt.Sprintf("fake-grant-%d", k.nextID)
+	if entry.Grants == nil {
+		entry.Grants = make(map[string]fakeGrant)
+	}
+	entry.Grants[grantID] = fakeGrant{
+		GranteePrincipal:  aws.StringValue(input.GranteePrincipal),
+		RetiringPrincipal: aws.StringValue(input.RetiringPrincipal),
+		Operations:        aws.StringValueSlice(input.Operations),
+	}
+
+	return &kms.CreateGrantOutput{
+		GrantId:    aws.String(grantID),
+		GrantToken: aws.String("token-" + grantID),
+	}, nil
+}
+
+func (k *kmsClientFake) RetireGrantWithContext(ctx aws.Context, input *kms.RetireGrantInput, opts ...request.Option) (*kms.RetireGrantOutput, error) {
+	if k.retireGrantErr != nil {
+		return nil, k.retireGrantErr
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	entry, err := k.resolve(input.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	grantID := aws.StringValue(input.GrantId)
+	if _, ok := entry.Grants[grantID]; !ok {
+		return nil, awserr.New(kms.ErrCodeNotFoundException, fmt.Sprintf("grant %s is not found", grantID), nil)
+	}
+	delete(entry.Grants, grantID)
+
+	return &kms.RetireGrantOutput{}, nil
+}
+
+func (k *kmsClientFake) DisableKeyWithContext(ctx aws.Context, input *kms.DisableKeyInput, opts ...request.Option) (*kms.DisableKeyOutput, error) {
+	if k.disableKeyErr != nil {
+		return nil, k.disableKeyErr
+	}
+	if err := k.setKeyState(input.KeyId, kms.KeyStateDisabled); err != nil {
+		return nil, err
+	}
+	return &kms.DisableKeyOutput{}, nil
+}
+
+func (k *kmsClientFake) EnableKeyWithContext(ctx aws.Context, input *kms.EnableKeyInput, opts ...request.Option) (*kms.EnableKeyOutput, error) {
+	if k.enableKeyErr != nil {
+		return nil, k.enableKeyErr
+	}
+	if err := k.setKeyState(input.KeyId, kms.KeyStateEnabled); err != nil {
+		return nil, err
+	}
+	return &kms.EnableKeyOutput{}, nil
+}
+
+func (k *kmsClientFake) TagResourceWithContext(ctx aws.Context, input *kms.TagResourceInput, opts ...request.Option) (*kms.TagResourceOutput, error) {
+	if k.tagResourceErr != nil {
+		return nil, k.tagResourceErr
+	}
+	if strings.HasPrefix(aws.StringValue(input.KeyId), aliasPrefix) {
+		return nil, awserr.New(kms.ErrCodeInvalidArnException, "aliases are not supported", nil)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	entry, err := k.resolve(input.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Tags == nil {
+		entry.Tags = make(map[string]string)
+	}
+	for _, tag := range input.Tags {
+		entry.Tags[aws.StringValue(tag.TagKey)] = aws.StringValue(tag.TagValue)
+	}
+	return &kms.TagResourceOutput{}, nil
+}
+
+// setKeyState toggles a key between enabled and disabled. Like KMS, aliases
+// are not accepted.
+func (k *kmsClientFake) setKeyState(keyID *string, keyState string) error {
+	if strings.HasPrefix(aws.StringValue(keyID), aliasPrefix) {
+		return awserr.New("ValidationException", fmt.Sprintf("aliases are not supported: %s", aws.StringValue(keyID)), nil)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	entry, err := k.resolve(keyID)
+	if err != nil {
+		return err
+	}
+	if entry.KeyState != kms.KeyStateEnabled && entry.KeyState != kms.KeyStateDisabled {
+		return awserr.New(kms.ErrCodeInvalidStateException, fmt.Sprintf("%s is %s", entry.arn(), entry.KeyState), nil)
+	}
+	entry.KeyState = keyState
+	return nil
+}
+
+func (k *kmsClientFake) ScheduleKeyDeletionWithContext(ctx aws.Context, input *kms.ScheduleKeyDeletionInput, opts ...request.Option) (*kms.ScheduleKeyDeletionOutput, error) {
+	if k.scheduleKeyDeletionErr != nil {
+		return nil, k.scheduleKeyDeletionErr
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	entry, err := k.resolve(input.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	if entry.KeyState == kms.KeyStatePendingDeletion {
+		return nil, awserr.New(kms.ErrCodeInvalidStateException, fmt.Sprintf("%s is pending deletion", entry.arn()), nil)
+	}
+
+	window := aws.Int64Value(input.PendingWindowInDays)
+	if window == 0 {
+		window = 30
+	}
+	if window < 7 || window > 30 {
+		return nil, awserr.New("ValidationException", fmt.Sprintf("invalid pending window %d", window), nil)
+	}
+	entry.KeyState = kms.KeyStatePendingDeletion
+	entry.PendingWindowInDays = window
+
+	return &kms.ScheduleKeyDeletionOutput{
+		KeyId:        aws.String(entry.arn()),
+		DeletionDate: aws.Time(time.Now().Add(time.Duration(window) * 24 * time.Hour)),
+	}, nil
+}
+
+func (k *kmsClientFake) SignWithContext(ctx aws.Context, input *kms.SignInput, opts ...request.Option) (*kms.SignOutput, error) {
+	if k.signErr != nil {
+		return nil, k.signErr
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	entry, err := k.resolve(input.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	switch entry.KeyState {
+	case kms.KeyStateEnabled:
+	case kms.KeyStateDisabled:
+		return nil, awserr.New(kms.ErrCodeDisabledException, fmt.Sprintf("%s is disabled", entry.arn()), nil)
+	default:
+		return nil, awserr.New(kms.ErrCodeInvalidStateException, fmt.Sprintf("%s is %s", entry.arn(), entry.KeyState), nil)
+	}
+
+	signature, err := entry.sign(aws.StringValue(input.SigningAlgorithm), aws.StringValue(input.MessageType), input.Message)
+	if err != nil {
+		return nil, err
+	}
+	if k.tamperSignatures {
+		signature[len(signature)/2] ^= 0xff
+	}
+
+	return &kms.SignOutput{
+		KeyId:            aws.String(entry.arn()),
+		Signature:        signature,
+		SigningAlgorithm: input.SigningAlgorithm,
+	}, nil
+}
+
+func (k *kmsClientFake) CreateAliasWithContext(ctx aws.Context, input *kms.CreateAliasInput, opts ...request.Option) (*kms.CreateAliasOutput, error) {
+	if k.createAliasErr != nil {
+		return nil, k.createAliasErr
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	aliasName := aws.StringValue(input.AliasName)
+	if _, ok := k.aliases[aliasName]; ok {
+		return nil, awserr.New(kms.ErrCodeAlreadyExistsException, fmt.Sprintf("alias %s already exists", aliasName), nil)
+	}
+	entry, err := k.resolve(input.TargetKeyId)
+	if err != nil {
+		return nil, err
+	}
+	k.aliases[aliasName] = entry.KeyID
+
+	return &kms.CreateAliasOutput{}, nil
+}
+
+func (k *kmsClientFake) UpdateAliasWithContext(ctx aws.Context, input *kms.UpdateAliasInput, opts ...request.Option) (*kms.UpdateAliasOutput, error) {
+	if k.updateAliasErr != nil {
+		return nil, k.updateAliasErr
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	aliasName := aws.StringValue(input.AliasName)
+	if _, ok := k.aliases[aliasName]; !ok {
+		return nil, awserr.New(kms.ErrCodeNotFoundException, fmt.Sprintf("alias %s is not found", aliasName), nil)
+	}
+	entry, err := k.resolve(input.TargetKeyId)
+	if err != nil {
+		return nil, err
+	}
+	k.aliases[aliasName] = entry.KeyID
+
+	return &kms.UpdateAliasOutput{}, nil
+}
+
+func (k *kmsClientFake) DeleteAliasWithContext(ctx aws.Context, input *kms.DeleteAliasInput, opts ...request.Option) (*kms.DeleteAliasOutput, error) {
+	if k.deleteAliasErr != nil {
+		return nil, k.deleteAliasErr
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	aliasName := aws.StringValue(input.AliasName)
+	if _, ok := k.aliases[aliasName]; !ok {
+		return nil, awserr.New(kms.ErrCodeNotFoundException, fmt.Sprintf("alias %s is not found", aliasName), nil)
+	}
+	delete(k.aliases, aliasName)
+
+	return &kms.DeleteAliasOutput{}, nil
+}
+
+// setEntries seeds the fake with the given keys, generating key material for
+// the supported key specs and creating the aliases that were set.
+func (k *kmsClientFake) setEntries(entries []fakeKeyEntry) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, e := range entries {
+		entry := e
+		if entry.KeyID == "" {
+			k.nextID++
+			entry.KeyID = fmt.Sprintf("fake-key-%d", k.nextID)
+		}
+		if entry.KeyUsage == "" {
+			entry.KeyUsage = kms.KeyUsageTypeSignVerify
+		}
+		if entry.KeyState == "" {
+			entry.KeyState = kms.KeyStateEnabled
+		}
+		if entry.CreationDate.IsZero() {
+			entry.CreationDate = time.Now()
+		}
+		if _, err := keySpecKeyGenerator(entry.KeySpec); err == nil {
+			require.NoError(k.t, entry.generateKey())
+		}
+
+		k.keys[entry.KeyID] = &entry
+		if entry.AliasName != "" {
+			k.aliases[entry.AliasName] = entry.KeyID
+		}
+	}
+}
+
+// deleteKey removes a key and its aliases, like a key deleted once its
+// waiting period is over
+func (k *kmsClientFake) deleteKey(keyID string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	delete(k.keys, keyID)
+	for alias, target := range k.aliases {
+		if target == keyID {
+			delete(k.aliases, alias)
+		}
+	}
+}
+
+// aliasTarget returns the id of the key the given alias points to
+func (k *kmsClientFake) aliasTarget(aliasName string) (string, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keyID, ok := k.aliases[aliasName]
+	return keyID, ok
+}
+
+// keyEntry returns a copy of the key stored with the given id
+func (k *kmsClientFake) keyEntry(keyID string) (fakeKeyEntry, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	entry, ok := k.keys[keyID]
+	if !ok {
+		return fakeKeyEntry{}, false
+	}
+	return *entry, true
+}
+
+// waitInFlight waits for describeKeyDelay, keeping track of the calls
+// waiting at the same time
+func (k *kmsClientFake) waitInFlight(delay time.Duration, inFlight, maxInFlight *int) {
+	k.inFlightMu.Lock()
+	*inFlight++
+	if *inFlight > *maxInFlight {
+		*maxInFlight = *inFlight
+	}
+	k.inFlightMu.Unlock()
+
+	time.Sleep(delay)
+
+	k.inFlightMu.Lock()
+	*inFlight--
+	k.inFlightMu.Unlock()
+}
+
+// keyGrants returns a copy of the grants of a key
+func (k *kmsClientFake) keyGrants(keyID string) map[string]fakeGrant {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	grants := make(map[string]fakeGrant)
+	if entry, ok := k.keys[keyID]; ok {
+		for grantID, grant := range entry.Grants {
+			grants[grantID] = grant
+		}
+	}
+	return grants
+}
+
+// describeKeyCallCount returns the number of calls made to DescribeKey
+func (k *kmsClientFake) describeKeyCallCount() int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.describeKeyCalls
+}
+
+// keyEntries returns a copy of every key stored in the fake
+func (k *kmsClientFake) keyEntries() []fakeKeyEntry {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	var entries []fakeKeyEntry
+	for _, entry := range k.keys {
+		entries = append(entries, *entry)
+	}
+	return entries
+}
+
+// resolve looks up a key by id, ARN or alias name. Callers must hold the lock.
+func (k *kmsClientFake) resolve(keyID *string) (*fakeKeyEntry, error) {
+	id := aws.StringValue(keyID)
+	if strings.HasPrefix(id, aliasPrefix) {
+		target, ok := k.aliases[id]
+		if !ok {
+			return nil, awserr.New(kms.ErrCodeNotFoundException, fmt.Sprintf("alias %s is not found", id), nil)
+		}
+		id = target
+	}
+	if i := strings.LastIndex(id, ":key/"); i >= 0 {
+		id = id[i+len(":key/"):]
+	}
+
+	entry, ok := k.keys[id]
+	if !ok {
+		return nil, awserr.New(kms.ErrCodeNotFoundException, fmt.Sprintf("key %s is not found", id), nil)
+	}
+	return entry, nil
+}
+
+// page returns the bounds of the page that starts at marker, and the marker of
+// the next page, if any.
+func (k *kmsClientFake) page(total int, marker *string, limit *int64) (int, int, *string, error) {
+	start := 0
+	if marker != nil {
+		var err error
+		start, err = strconv.Atoi(*marker)
+		if err != nil || start > total {
+			return 0, 0, nil, awserr.New(kms.ErrCodeInvalidMarkerException, fmt.Sprintf("invalid marker %q", *marker), nil)
+		}
+	}
+
+	size := k.pageSize
+	if limit != nil {
+		size = int(*limit)
+	}
+
+	end := total
+	if size > 0 && start+size < total {
+		end = start + size
+	}
+
+	var nextMarker *string
+	if end < total {
+		nextMarker = aws.String(strconv.Itoa(end))
+	}
+	return start, end, nextMarker, nil
+}
+
+func (e *fakeKeyEntry) arn() string {
+	return fmt.Sprintf("arn:aws:kms:%s:%s:key/%s", fakeRegion, fakeAccountID, e.KeyID)
+}
+
+func (e *fakeKeyEntry) metadata() *kms.KeyMetadata {
+	creationDate := aws.Time(e.CreationDate)
+	if e.NoCreationDate {
+		creationDate = nil
+	}
+	signingAlgorithms := e.SigningAlgorithms
+	if signingAlgorithms == nil {
+		signingAlgorithms = signingAlgorithmsForSpec(e.KeySpec)
+	}
+	return &kms.KeyMetadata{
+		AWSAccountId:          aws.String(fakeAccountID),
+		Arn:                   aws.String(e.arn()),
+		CreationDate:          creationDate,
+		CustomerMasterKeySpec: aws.String(e.KeySpec),
+		Description:           aws.String(e.Description),
+		Enabled:               aws.Bool(e.KeyState == kms.KeyStateEnabled),
+		KeyId:                 aws.String(e.KeyID),
+		KeyManager:            aws.String(kms.KeyManagerTypeCustomer),
+		KeyState:              aws.String(e.KeyState),
+		KeyUsage:              aws.String(e.KeyUsage),
+		Origin:                aws.String(kms.OriginTypeAwsKms),
+		SigningAlgorithms:     aws.StringSlice(signingAlgorithms),
+	}
+}
+
+func (e *fakeKeyEntry) generateKey() error {
+	privateKey, err := fakeKeyForSpec(e.KeySpec)
+	if err != nil {
+		return err
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(privateKey.Public())
+	if err != nil {
+		return err
+	}
+
+	e.privateKey = privateKey
+	e.publicKey = publicKey
+	return nil
+}
+
+func (e *fakeKeyEntry) sign(signingAlgorithm, messageType string, message []byte) ([]byte, error) {
+	if e.privateKey == nil {
+		return nil, awserr.New(kms.ErrCodeInvalidKeyUsageException, "key cannot be used for signing", nil)
+	}
+
+	var supported bool
+	for _, algo := range signingAlgorithmsForSpec(e.KeySpec) {
+		supported = supported || algo == signingAlgorithm
+	}
+	if !supported {
+		return nil, awserr.New(kms.ErrCodeInvalidKeyUsageException, fmt.Sprintf("signing algorithm %s is not supported by %s keys", signingAlgorithm, e.KeySpec), nil)
+	}
+
+	hash, isPSS := fakeHashForSigningAlgorithm(signingAlgorithm)
+	digest := message
+	switch messageType {
+	case kms.MessageTypeDigest:
+		if len(message) != hash.Size() {
+			return nil, awserr.New("ValidationException", fmt.Sprintf("digest length %d does not match %s", len(message), signingAlgorithm), nil)
+		}
+	case kms.MessageTypeRaw:
+		if len(message) > 4096 {
+			return nil, awserr.New("ValidationException", fmt.Sprintf("message length %d exceeds 4096 bytes", len(message)), nil)
+		}
+		h := hash.New()
+		_, _ = h.Write(message)
+		digest = h.Sum(nil)
+	default:
+		return nil, awserr.New("ValidationException", fmt.Sprintf("unsupported message type %q", messageType), nil)
+	}
+
+	switch privateKey := e.privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		return ecdsa.SignASN1(rand.Reader, privateKey, digest)
+	case *rsa.PrivateKey:
+		if isPSS {
+			return rsa.SignPSS(rand.Reader, privateKey, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		return rsa.SignPKCS1v15(rand.Reader, privateKey, hash, digest)
+	default:
+		return nil, fmt.Errorf("unexpected private key type %T", privateKey)
+	}
+}
+
+func fakeKeyForSpec(keySpec string) (crypto.Signer, error) {
+	generate, err := keySpecKeyGenerator(keySpec)
+	if err != nil {
+		return nil, err
+	}
+
+	fakeKeysMu.Lock()
+	defer fakeKeysMu.Unlock()
+
+	if key, ok := fakeKeys[keySpec]; ok {
+		return key, nil
+	}
+	key, err := generate()
+	if err != nil {
+		return nil, err
+	}
+	fakeKeys[keySpec] = key
+	return key, nil
+}
+
+func keySpecKeyGenerator(keySpec string) (func() (crypto.Signer, error), error) {
+	switch keySpec {
+	case kms.CustomerMasterKeySpecRsa2048:
+		return func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 2048) }, nil
+	case kms.CustomerMasterKeySpecRsa4096:
+		return func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 4096) }, nil
+	case kms.CustomerMasterKeySpecEccNistP256:
+		return func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P256(), rand.Reader) }, nil
+	case kms.CustomerMasterKeySpecEccNistP384:
+		return func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P384(), rand.Reader) }, nil
+	default:
+		return nil, awserr.New("ValidationException", fmt.Sprintf("unsupported key spec %q", keySpec), nil)
+	}
+}
+
+func signingAlgorithmsForSpec(keySpec string) []string {
+	switch keySpec {
+	case kms.CustomerMasterKeySpecRsa2048, kms.CustomerMasterKeySpecRsa4096:
+		return []string{
+			kms.SigningAlgorithmSpecRsassaPssSha256,
+			kms.SigningAlgorithmSpecRsassaPssSha384,
+			kms.SigningAlgorithmSpecRsassaPssSha512,
+			kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256,
+			kms.SigningAlgorithmSpecRsassaPkcs1V15Sha384,
+			kms.SigningAlgorithmSpecRsassaPkcs1V15Sha512,
+		}
+	case kms.CustomerMasterKeySpecEccNistP256:
+		return []string{kms.SigningAlgorithmSpecEcdsaSha256}
+	case kms.CustomerMasterKeySpecEccNistP384:
+		return []string{kms.SigningAlgorithmSpecEcdsaSha384}
+	default:
+		return nil
+	}
+}
+
+func fakeHashForSigningAlgorithm(signingAlgorithm string) (crypto.Hash, bool) {
+	switch signingAlgorithm {
+	case kms.SigningAlgorithmSpecRsassaPssSha256:
+		return crypto.SHA256, true
+	case kms.SigningAlgorithmSpecRsassaPssSha384:
+		return crypto.SHA384, true
+	case kms.SigningAlgorithmSpecRsassaPssSha512:
+		return crypto.SHA512, true
+	case kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256, kms.SigningAlgorithmSpecEcdsaSha256:
+		return crypto.SHA256, false
+	case kms.SigningAlgorithmSpecRsassaPkcs1V15Sha384, kms.SigningAlgorithmSpecEcdsaSha384:
+		return crypto.SHA384, false
+	default:
+		return crypto.SHA512, false
+	}
+}
+
+// stsClientFake returns a fixed caller identity, and counts the calls
+type stsClientFake struct {
+	arn   string
+	err   error
+	calls int
+}
+
+func (s *stsClientFake) GetCallerIdentityWithContext(ctx aws.Context, input *sts.GetCallerIdentityInput, opts ...request.Option) (*sts.GetCallerIdentityOutput, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &sts.GetCallerIdentityOutput{
+		Account: aws.String(strings.Split(s.arn, ":")[4]),
+		Arn:     aws.String(s.arn),
+	}, nil
+}
@@ -0,0 +1,360 @@
+package kms
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewKMSClient(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		config *Config
+	}{
+		{
+			name: "static credentials",
+			config: &Config{
+				AccessKeyID:     validAccessKeyID,
+				SecretAccessKey: validSecretAccessKey,
+				Region:          validRegion,
+			},
+		},
+		{
+			name: "default credential chain",
+			config: &Config{
+				Region: validRegion,
+			},
+		},
+		{
+			name: "assume role",
+			config: &Config{
+				Region:          validRegion,
+				AssumeRoleARN:   "arn:aws:iam::123456789012:role/spire-server",
+				RoleSessionName: "spire-server",
+			},
+		},
+		{
+			name: "web identity",
+			config: &Config{
+				Region:               validRegion,
+				WebIdentityRoleARN:   "arn:aws:iam::123456789012:role/spire-server",
+				WebIdentityTokenFile: "/var/run/secrets/eks.amazonaws.com/serviceaccount/token",
+			},
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := newKMSClient(tt.config)
+			require.NoError(t, err)
+			require.NotNil(t, client)
+		})
+	}
+}
+
+func TestNewAWSConfig(t *testing.T) {
+	awsConfig := newAWSConfig(&Config{Region: validRegion})
+	require.Equal(t, validRegion, *awsConfig.Region)
+	require.Nil(t, awsConfig.Credentials)
+	require.Equal(t, endpoints.RegionalSTSEndpoint, awsConfig.STSRegionalEndpoint)
+
+	awsConfig = newAWSConfig(&Config{
+		AccessKeyID:     validAccessKeyID,
+		SecretAccessKey: validSecretAccessKey,
+		Region:          validRegion,
+	})
+	require.NotNil(t, awsConfig.Credentials)
+	creds, err := awsConfig.Credentials.Get()
+	require.NoError(t, err)
+	require.Equal(t, credentials.StaticProviderName, creds.ProviderName)
+	require.Equal(t, validAccessKeyID, creds.AccessKeyID)
+	require.Equal(t, validSecretAccessKey, creds.SecretAccessKey)
+}
+
+func TestNewSessionOptions(t *testing.T) {
+	opts, err := newSessionOptions(&Config{Region: validRegion})
+	require.NoError(t, err)
+	require.Equal(t, validRegion, *opts.Config.Region)
+	require.Empty(t, opts.Profile)
+	require.Equal(t, session.SharedConfigStateFromEnv, opts.SharedConfigState)
+	require.Nil(t, opts.Config.HTTPClient)
+
+	opts, err = newSessionOptions(&Config{
+		Region:      validRegion,
+		KMSEndpoint: "http://localhost:4566",
+		Profile:     "spire-server",
+		HTTPProxy:   "http://proxy.example.org:3128",
+	})
+	require.NoError(t, err)
+	require.Equal(t, validRegion, *opts.Config.Region)
+	require.NotNil(t, opts.Config.HTTPClient)
+	require.Nil(t, opts.Config.Credentials)
+	require.Equal(t, "spire-server", opts.Profile)
+	require.Equal(t, session.SharedConfigEnable, opts.SharedConfigState)
+}
+
+func TestNewHTTPClientWithProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+	}))
+	defer proxy.Close()
+
+	client, err := newHTTPClient(&Config{HTTPProxy: proxy.URL})
+	require.NoError(t, err)
+
+	resp, err := client.Get("http://kms.us-west-2.amazonaws.com/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, []string{"http://kms.us-west-2.amazonaws.com/"}, proxied)
+}
+
+func TestNewHTTPClientWithCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "kms-ca-bundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	bundlePath := filepath.Join(dir, "ca.pem")
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, ioutil.WriteFile(bundlePath, bundle, 0600))
+	emptyPath := filepath.Join(dir, "empty.pem")
+	require.NoError(t, ioutil.WriteFile(emptyPath, nil, 0600))
+
+	// The server is only trusted with the bundle
+	client, err := newHTTPClient(&Config{CABundlePath: bundlePath})
+	require.NoError(t, err)
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	_, err = http.Get(server.URL)
+	require.Error(t, err)
+
+	_, err = newHTTPClient(&Config{CABundlePath: emptyPath})
+	require.EqualError(t, err, fmt.Sprintf("no certificates found in CA bundle %q", emptyPath))
+	_, err = newHTTPClient(&Config{CABundlePath: filepath.Join(dir, "missing.pem")})
+	require.Error(t, err)
+}
+
+func TestParseProxyURL(t *testing.T) {
+	proxyURL, err := parseProxyURL("https://proxy.example.org:3128")
+	require.NoError(t, err)
+	require.Equal(t, "proxy.example.org:3128", proxyURL.Host)
+
+	_, err = parseProxyURL("proxy.example.org:3128")
+	require.EqualError(t, err, `"proxy.example.org:3128" is not an http or https URL`)
+	_, err = parseProxyURL("socks5://proxy.example.org:1080")
+	require.EqualError(t, err, `"socks5://proxy.example.org:1080" is not an http or https URL`)
+}
+
+func TestEndpointsForPartitions(t *testing.T) {
+	for _, tt := range []struct {
+		region      string
+		kmsEndpoint string
+		stsEndpoint string
+	}{
+		{
+			region:      "us-west-2",
+			kmsEndpoint: "https://kms.us-west-2.amazonaws.com",
+			stsEndpoint: "https://sts.us-west-2.amazonaws.com",
+		},
+		{
+			region:      "us-gov-west-1",
+			kmsEndpoint: "https://kms.us-gov-west-1.amazonaws.com",
+			stsEndpoint: "https://sts.us-gov-west-1.amazonaws.com",
+		},
+		{
+			region:      "cn-north-1",
+			kmsEndpoint: "https://kms.cn-north-1.amazonaws.com.cn",
+			stsEndpoint: "https://sts.cn-north-1.amazonaws.com.cn",
+		},
+	} {
+		tt := tt
+		t.Run(tt.region, func(t *testing.T) {
+			config := &Config{Region: tt.region}
+
+			client, err := newKMSClient(config)
+			require.NoError(t, err)
+			require.Equal(t, tt.kmsEndpoint, client.(*kms.KMS).Endpoint)
+
+			stsClient, err := newSTSClient(config)
+			require.NoError(t, err)
+			require.Equal(t, tt.stsEndpoint, stsClient.(*sts.STS).Endpoint)
+		})
+	}
+}
+
+func TestARNPartition(t *testing.T) {
+	require.Equal(t, "aws", arnPartition("arn:aws:iam::123456789012:role/spire-server"))
+	require.Equal(t, "aws-us-gov", arnPartition("arn:aws-us-gov:kms:us-gov-west-1:123456789012:key/1234"))
+	require.Equal(t, "aws-cn", arnPartition("arn:aws-cn:iam::123456789012:root"))
+	require.Equal(t, "", arnPartition("not-an-arn"))
+}
+
+func TestNewKMSConfig(t *testing.T) {
+	s, err := session.NewSession()
+	require.NoError(t, err)
+
+	kmsConfig := newKMSConfig(&Config{Region: validRegion}, s)
+	require.Equal(t, 0, *kmsConfig.MaxRetries)
+	require.Nil(t, kmsConfig.Endpoint)
+	require.Nil(t, kmsConfig.Credentials)
+
+	kmsConfig = newKMSConfig(&Config{
+		Region:        validRegion,
+		KMSEndpoint:   "http://localhost:4566",
+		AssumeRoleARN: "arn:aws:iam::123456789012:role/spire-server",
+	}, s)
+	require.Equal(t, "http://localhost:4566", *kmsConfig.Endpoint)
+	require.NotNil(t, kmsConfig.Credentials)
+}
+
+func TestNewKMSConfigWithFIPSEndpoint(t *testing.T) {
+	s, err := session.NewSession()
+	require.NoError(t, err)
+
+	kmsConfig := newKMSConfig(&Config{
+		Region:          "us-gov-west-1",
+		UseFIPSEndpoint: true,
+		AssumeRoleARN:   "arn:aws-us-gov:iam::123456789012:role/spire-server",
+	}, s)
+	require.Equal(t, "https://kms-fips.us-gov-west-1.amazonaws.com", *kmsConfig.Endpoint)
+	require.NotNil(t, kmsConfig.Credentials)
+}
+
+func TestFIPSEndpoint(t *testing.T) {
+	for _, tt := range []struct {
+		region   string
+		endpoint string
+		err      string
+	}{
+		{region: "us-east-1", endpoint: "https://kms-fips.us-east-1.amazonaws.com"},
+		{region: "ca-central-1", endpoint: "https://kms-fips.ca-central-1.amazonaws.com"},
+		{region: "us-gov-east-1", endpoint: "https://kms-fips.us-gov-east-1.amazonaws.com"},
+		{region: "cn-north-1", err: `no FIPS endpoint in region "cn-north-1"`},
+		{region: "us-east1", err: `no FIPS endpoint in region "us-east1"`},
+	} {
+		endpoint, err := fipsEndpoint(tt.region)
+		if tt.err != "" {
+			require.EqualError(t, err, tt.err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tt.endpoint, endpoint)
+	}
+}
+
+func TestNewWebIdentityRoleProvider(t *testing.T) {
+	s, err := session.NewSession()
+	require.NoError(t, err)
+
+	provider := newWebIdentityRoleProvider(&Config{Region: validRegion}, s)
+	require.Nil(t, provider)
+
+	provider = newWebIdentityRoleProvider(&Config{
+		Region:               validRegion,
+		WebIdentityRoleARN:   "arn:aws:iam::123456789012:role/spire-server",
+		WebIdentityTokenFile: "/var/run/secrets/eks.amazonaws.com/serviceaccount/token",
+	}, s)
+	require.NotNil(t, provider)
+
+	// The web identity replaces the credentials of the session: they are
+	// retrieved with the token file, which doesn't exist here
+	s, err = newSession(&Config{
+		Region:               validRegion,
+		WebIdentityRoleARN:   "arn:aws:iam::123456789012:role/spire-server",
+		WebIdentityTokenFile: filepath.Join(os.TempDir(), "missing-web-identity-token"),
+	})
+	require.NoError(t, err)
+	_, err = s.Config.Credentials.Get()
+	var awsErr awserr.Error
+	require.True(t, errors.As(err, &awsErr), "%v", err)
+	require.Equal(t, stscreds.ErrCodeWebIdentity, awsErr.Code())
+}
+
+func TestNewCredentialSourceProvider(t *testing.T) {
+	s, err := session.NewSession()
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		config           *Config
+		expectedProvider credentials.Provider
+	}{
+		{
+			config: &Config{Region: validRegion},
+		},
+		{
+			config: &Config{Region: validRegion, CredentialSource: credentialSourceDefault},
+		},
+		{
+			config: &Config{
+				Region:           validRegion,
+				CredentialSource: credentialSourceStatic,
+				AccessKeyID:      "access_key_id",
+				SecretAccessKey:  "secret_access_key",
+			},
+			expectedProvider: &credentials.StaticProvider{},
+		},
+		{
+			config:           &Config{Region: validRegion, CredentialSource: credentialSourceEnvironment},
+			expectedProvider: &credentials.EnvProvider{},
+		},
+		{
+			config:           &Config{Region: validRegion, CredentialSource: credentialSourceInstance},
+			expectedProvider: &ec2rolecreds.EC2RoleProvider{},
+		},
+	} {
+		provider := newCredentialSourceProvider(tt.config, s)
+		if tt.expectedProvider == nil {
+			require.Nil(t, provider, tt.config.CredentialSource)
+			continue
+		}
+		require.IsType(t, tt.expectedProvider, provider, tt.config.CredentialSource)
+	}
+
+	// The session is only given the credentials of the source
+	os.Setenv("AWS_ACCESS_KEY_ID", "env_access_key_id")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "env_secret_access_key")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	s, err = newSession(&Config{Region: validRegion, CredentialSource: credentialSourceEnvironment})
+	require.NoError(t, err)
+	value, err := s.Config.Credentials.Get()
+	require.NoError(t, err)
+	require.Equal(t, credentials.EnvProviderName, value.ProviderName)
+}
+
+func TestNewAssumeRoleProvider(t *testing.T) {
+	s, err := session.NewSession()
+	require.NoError(t, err)
+
+	provider := newAssumeRoleProvider(&Config{Region: validRegion}, s)
+	require.Nil(t, provider)
+
+	provider = newAssumeRoleProvider(&Config{
+		Region:          validRegion,
+		AssumeRoleARN:   "arn:aws:iam::123456789012:role/spire-server",
+		RoleSessionName: "spire-server",
+	}, s)
+	require.NotNil(t, provider)
+	require.NotNil(t, provider.Client)
+	require.Equal(t, "arn:aws:iam::123456789012:role/spire-server", provider.RoleARN)
+	require.Equal(t, "spire-server", provider.RoleSessionName)
+}
@@ -0,0 +1,115 @@
+package kms
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// deletionFlushSpacing spaces the ScheduleKeyDeletion calls of a flush, which
+// share a low request quota of KMS with the other key management calls
+const deletionFlushSpacing = 200 * time.Millisecond
+
+// deletionQueue holds the replaced keys whose deletion is deferred, when
+// deletion_flush_interval is set. Keys are queued by KMS key id, so that a key
+// queued more than once is only deleted once.
+type deletionQueue struct {
+	mu   sync.Mutex
+	keys map[string]string
+}
+
+func newDeletionQueue() *deletionQueue {
+	return &deletionQueue{keys: make(map[string]string)}
+}
+
+func (q *deletionQueue) add(spireKeyID, kmsKeyID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.keys[kmsKeyID] = spireKeyID
+}
+
+func (q *deletionQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.keys)
+}
+
+// drain empties the queue, and returns the KMS key ids it held, sorted, along
+// with their SPIRE key ids
+func (q *deletionQueue) drain() ([]string, map[string]string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	keys := q.keys
+	q.keys = make(map[string]string)
+	kmsKeyIDs := make([]string, 0, len(keys))
+	for kmsKeyID := range keys {
+		kmsKeyIDs = append(kmsKeyIDs, kmsKeyID)
+	}
+	sort.Strings(kmsKeyIDs)
+	return kmsKeyIDs, keys
+}
+
+// deleteReplacedKey schedules the deletion of a key replaced by GenerateKey,
+// or queues it until the next flush when deletions are deferred
+func (p *Plugin) deleteReplacedKey(spireKeyID, kmsKeyID string) {
+	if !p.deferKeyDeletion {
+		p.scheduleKeyDeletion(p.background, spireKeyID, kmsKeyID)
+		return
+	}
+	p.deletionQueue.add(spireKeyID, kmsKeyID)
+	p.log.Debug("Queued key deletion", spireKeyIDTag, spireKeyID, keyIDTag, kmsKeyID)
+}
+
+// flushDeletions schedules the deletion of the queued keys, one at a time,
+// calling KMS with ctx. When stop is closed, the keys left are queued again
+// for the next flush.
+func (p *Plugin) flushDeletions(ctx context.Context, stop <-chan struct{}) {
+	kmsKeyIDs, spireKeyIDs := p.deletionQueue.drain()
+	if len(kmsKeyIDs) == 0 {
+		return
+	}
+	p.log.Info("Flushing queued key deletions", "count", len(kmsKeyIDs))
+
+	for i, kmsKeyID := range kmsKeyIDs {
+		if i > 0 {
+			select {
+			case <-stop:
+				for _, kmsKeyID := range kmsKeyIDs[i:] {
+					p.deletionQueue.add(spireKeyIDs[kmsKeyID], kmsKeyID)
+				}
+				return
+			case <-time.After(deletionFlushSpacing):
+			}
+		}
+		p.scheduleKeyDeletion(ctx, spireKeyIDs[kmsKeyID], kmsKeyID)
+	}
+}
+
+// startDeletionFlush flushes the queued deletions every interval, until
+// stopDeletionFlush is called. Close flushes the keys queued since.
+func (p *Plugin) startDeletionFlush(interval time.Duration) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				p.flushDeletions(p.background, stop)
+			}
+		}
+	}()
+
+	p.stopDeletionFlush = func() {
+		close(stop)
+		<-done
+	}
+}
@@ -0,0 +1,121 @@
+package kms
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/hashicorp/go-hclog"
+	"github.com/spiffe/spire/proto/spire/common/plugin"
+	"github.com/spiffe/spire/proto/spire/server/keymanager"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeletionQueue(t *testing.T) {
+	newTestPlugin := func(t *testing.T, interval string) (*Plugin, *kmsClientFake, *countingDeletionClient) {
+		fake := newKMSClientFake(t)
+		client := &countingDeletionClient{kmsClient: fake}
+		p := newPlugin(func(c *Config) (kmsClient, error) {
+			return client, nil
+		})
+		p.SetLogger(hclog.NewNullLogger())
+		_, err := p.Configure(ctx, &plugin.ConfigureRequest{
+			Configuration: fmt.Sprintf(`{"region": "%s", "key_policy": "{}", "deletion_flush_interval": %q}`, validRegion, interval),
+		})
+		require.NoError(t, err)
+		return p, fake, client
+	}
+	// generateKeys generates each key twice, and returns the ids of the
+	// replaced keys
+	generateKeys := func(t *testing.T, p *Plugin, spireKeyIDs ...string) []string {
+		var replaced []string
+		for _, spireKeyID := range spireKeyIDs {
+			for i := 0; i < 2; i++ {
+				if entry, ok := p.entry(spireKeyID); ok {
+					replaced = append(replaced, entry.KMSKeyID)
+				}
+				_, err := p.GenerateKey(ctx, &keymanager.GenerateKeyRequest{
+					KeyId:   spireKeyID,
+					KeyType: keymanager.KeyType_EC_P256,
+				})
+				require.NoError(t, err)
+			}
+		}
+		return replaced
+	}
+	requireDeletedOnce := func(t *testing.T, fake *kmsClientFake, client *countingDeletionClient, replaced []string) {
+		deletions := client.deletions()
+		require.Len(t, deletions, len(replaced))
+		for _, kmsKeyID := range replaced {
+			require.Equal(t, 1, deletions[kmsKeyID])
+			key, ok := fake.keyEntry(kmsKeyID)
+			require.True(t, ok)
+			require.Equal(t, kms.KeyStatePendingDeletion, key.KeyState)
+		}
+	}
+
+	t.Run("flushed on close", func(t *testing.T) {
+		p, fake, client := newTestPlugin(t, "1h")
+		replaced := generateKeys(t, p, "spireKeyID-1", "spireKeyID-2", "spireKeyID-3")
+		require.Eventually(t, func() bool {
+			return p.deletionQueue.len() == len(replaced)
+		}, time.Second, 10*time.Millisecond)
+
+		// A key queued again is still deleted once
+		p.deleteReplacedKey("spireKeyID-1", replaced[0])
+		require.Equal(t, len(replaced), p.deletionQueue.len())
+		require.Empty(t, client.deletions())
+		for _, kmsKeyID := range replaced {
+			key, ok := fake.keyEntry(kmsKeyID)
+			require.True(t, ok)
+			require.Equal(t, kms.KeyStateEnabled, key.KeyState)
+		}
+
+		require.NoError(t, p.Close())
+		require.Zero(t, p.deletionQueue.len())
+		requireDeletedOnce(t, fake, client, replaced)
+	})
+
+	t.Run("flushed on interval", func(t *testing.T) {
+		p, fake, client := newTestPlugin(t, "50ms")
+		replaced := generateKeys(t, p, "spireKeyID-1", "spireKeyID-2")
+		require.Eventually(t, func() bool {
+			return len(client.deletions()) == len(replaced)
+		}, 5*time.Second, 10*time.Millisecond)
+
+		require.NoError(t, p.Close())
+		requireDeletedOnce(t, fake, client, replaced)
+	})
+}
+
+// countingDeletionClient counts the ScheduleKeyDeletion calls per key id
+type countingDeletionClient struct {
+	kmsClient
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (c *countingDeletionClient) deletions() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]int, len(c.counts))
+	for kmsKeyID, count := range c.counts {
+		counts[kmsKeyID] = count
+	}
+	return counts
+}
+
+func (c *countingDeletionClient) ScheduleKeyDeletionWithContext(ctx aws.Context, input *kms.ScheduleKeyDeletionInput, opts ...request.Option) (*kms.ScheduleKeyDeletionOutput, error) {
+	c.mu.Lock()
+	if c.counts == nil {
+		c.counts = make(map[string]int)
+	}
+	c.counts[aws.StringValue(input.KeyId)]++
+	c.mu.Unlock()
+	return c.kmsClient.ScheduleKeyDeletionWithContext(ctx, input, opts...)
+}
@@ -0,0 +1,58 @@
+package kms
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// TransientError is a failed KMS call that may succeed when retried later,
+// such as a throttled call or a server error. The errors of the plugin wrap
+// it, so that callers can find it with errors.As.
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
+
+// PermanentError is a failed KMS call that fails the same when retried, such
+// as an invalid request, a denied permission or a missing key, until the
+// configuration or the key is fixed. The errors of the plugin wrap it, so that
+// callers can find it with errors.As.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// classifyError wraps an AWS error in a TransientError when it is throttling,
+// a server-side or network failure, or one of the KMS codes the retries are
+// made for, and in a PermanentError otherwise. Other errors are returned as
+// they are.
+func classifyError(err error) error {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return err
+	}
+	var transient *TransientError
+	var permanent *PermanentError
+	if errors.As(err, &transient) || errors.As(err, &permanent) {
+		return err
+	}
+	if isRetryableError(aerr) {
+		return &TransientError{Err: err}
+	}
+	return &PermanentError{Err: err}
+}
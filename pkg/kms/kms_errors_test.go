@@ -0,0 +1,103 @@
+package kms
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyError(t *testing.T) {
+	for _, tt := range []struct {
+		name              string
+		err               error
+		expectedTransient bool
+		expectedPermanent bool
+	}{
+		{
+			name:              "throttling",
+			err:               awserr.New("ThrottlingException", "rate exceeded", nil),
+			expectedTransient: true,
+		},
+		{
+			name:              "resource quota",
+			err:               awserr.New(kms.ErrCodeLimitExceededException, "limit exceeded", nil),
+			expectedPermanent: true,
+		},
+		{
+			name:              "internal error",
+			err:               awserr.New(kms.ErrCodeInternalException, "internal error", nil),
+			expectedTransient: true,
+		},
+		{
+			name:              "key unavailable",
+			err:               awserr.New(kms.ErrCodeKeyUnavailableException, "key unavailable", nil),
+			expectedTransient: true,
+		},
+		{
+			name:              "dependency timeout",
+			err:               awserr.New(kms.ErrCodeDependencyTimeoutException, "timeout", nil),
+			expectedTransient: true,
+		},
+		{
+			name:              "service unavailable",
+			err:               awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "unavailable", nil), 503, "request-id"),
+			expectedTransient: true,
+		},
+		{
+			name:              "network error",
+			err:               awserr.New(request.ErrCodeRequestError, "send request failed", errors.New("connection reset by peer")),
+			expectedTransient: true,
+		},
+		{
+			name:              "validation",
+			err:               awserr.NewRequestFailure(awserr.New("ValidationException", "invalid message", nil), 400, "request-id"),
+			expectedPermanent: true,
+		},
+		{
+			name:              "access denied",
+			err:               fmt.Errorf("permission kms:Sign is missing: %w", awserr.New(accessDeniedErrCode, "not authorized", nil)),
+			expectedPermanent: true,
+		},
+		{
+			name:              "not found",
+			err:               awserr.New(kms.ErrCodeNotFoundException, "not found", nil),
+			expectedPermanent: true,
+		},
+		{
+			name:              "invalid key state",
+			err:               awserr.New(kms.ErrCodeInvalidStateException, "pending deletion", nil),
+			expectedPermanent: true,
+		},
+		{
+			name:              "disabled",
+			err:               awserr.New(kms.ErrCodeDisabledException, "disabled", nil),
+			expectedPermanent: true,
+		},
+		{
+			name: "not an AWS error",
+			err:  errors.New("some error"),
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyError(tt.err)
+			require.EqualError(t, err, tt.err.Error())
+
+			var transient *TransientError
+			var permanent *PermanentError
+			require.Equal(t, tt.expectedTransient, errors.As(err, &transient))
+			require.Equal(t, tt.expectedPermanent, errors.As(err, &permanent))
+			if !tt.expectedTransient && !tt.expectedPermanent {
+				require.Equal(t, tt.err, err)
+			}
+
+			// Classified errors are not wrapped again
+			require.Equal(t, err, classifyError(err))
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package kms
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// multiRegionKeyIDPrefix starts the ids of multi-region keys, which are the
+// same in every region the key is replicated to
+const multiRegionKeyIDPrefix = "mrk-"
+
+// fallbackClient is a kmsClient that calls the read operations on
+// multi-region keys (DescribeKey, GetPublicKey and Sign) again in the
+// fallback region, when the primary region is unavailable. The other calls,
+// and the calls on single-region keys or aliases, only go to the primary
+// region: aliases are not replicated.
+type fallbackClient struct {
+	kmsClient
+
+	fallback kmsClient
+	region   string
+	// onFallback is called before a call is made in the fallback region
+	onFallback func(op, keyID string, err error)
+}
+
+func newFallbackClient(primary, fallback kmsClient, region string, onFallback func(op, keyID string, err error)) *fallbackClient {
+	return &fallbackClient{
+		kmsClient:  primary,
+		fallback:   fallback,
+		region:     region,
+		onFallback: onFallback,
+	}
+}
+
+func (c *fallbackClient) DescribeKeyWithContext(ctx aws.Context, input *kms.DescribeKeyInput, opts ...request.Option) (*kms.DescribeKeyOutput, error) {
+	out, err := c.kmsClient.DescribeKeyWithContext(ctx, input, opts...)
+	keyID, ok := c.fallbackKeyID(err, input.KeyId)
+	if !ok {
+		return out, err
+	}
+	c.onFallback("kms:DescribeKey", aws.StringValue(input.KeyId), err)
+	fallbackInput := *input
+	fallbackInput.KeyId = keyID
+	return c.fallback.DescribeKeyWithContext(ctx, &fallbackInput, opts...)
+}
+
+func (c *fallbackClient) GetPublicKeyWithContext(ctx aws.Context, input *kms.GetPublicKeyInput, opts ...request.Option) (*kms.GetPublicKeyOutput, error) {
+	out, err := c.kmsClient.GetPublicKeyWithContext(ctx, input, opts...)
+	keyID, ok := c.fallbackKeyID(err, input.KeyId)
+	if !ok {
+		return out, err
+	}
+	c.onFallback("kms:GetPublicKey", aws.StringValue(input.KeyId), err)
+	fallbackInput := *input
+	fallbackInput.KeyId = keyID
+	return c.fallback.GetPublicKeyWithContext(ctx, &fallbackInput, opts...)
+}
+
+func (c *fallbackClient) SignWithContext(ctx aws.Context, input *kms.SignInput, opts ...request.Option) (*kms.SignOutput, error) {
+	out, err := c.kmsClient.SignWithContext(ctx, input, opts...)
+	keyID, ok := c.fallbackKeyID(err, input.KeyId)
+	if !ok {
+		return out, err
+	}
+	c.onFallback("kms:Sign", aws.StringValue(input.KeyId), err)
+	fallbackInput := *input
+	fallbackInput.KeyId = keyID
+	return c.fallback.SignWithContext(ctx, &fallbackInput, opts...)
+}
+
+// fallbackKeyID returns the id of the key in the fallback region, when a call
+// on it failed because the primary region is unavailable and the key is a
+// multi-region key. Key ARNs are moved to the fallback region.
+func (c *fallbackClient) fallbackKeyID(err error, keyID *string) (*string, bool) {
+	if err == nil || !isRegionUnavailableError(err) {
+		return nil, false
+	}
+
+	id := aws.StringValue(keyID)
+	if !isKeyARN(id) {
+		return keyID, strings.HasPrefix(id, multiRegionKeyIDPrefix)
+	}
+	arn := strings.SplitN(id, ":", 6)
+	if !strings.HasPrefix(arn[5], "key/"+multiRegionKeyIDPrefix) {
+		return nil, false
+	}
+	arn[3] = c.region
+	return aws.String(strings.Join(arn, ":")), true
+}
+
+// isRegionUnavailableError tells if err is a server-side or network failure,
+// after which the region is deemed unavailable. Throttling is not: the
+// fallback region would not help, and it has its own quotas to preserve.
+func isRegionUnavailableError(err error) bool {
+	var aerr awserr.Error
+	return isRetryableError(err) && errors.As(err, &aerr) && !request.IsErrorThrottle(aerr)
+}
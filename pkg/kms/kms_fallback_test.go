@@ -0,0 +1,194 @@
+package kms
+
+import (
+	"crypto"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/hashicorp/go-hclog"
+	"github.com/spiffe/spire/pkg/server/plugin/keymanager"
+	"github.com/spiffe/spire/proto/spire/common/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+const multiRegionKeyID = "mrk-1234abcd12ab34cd56ef1234567890ab"
+
+func TestFallbackClient(t *testing.T) {
+	unavailableErr := awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "unavailable", nil), 503, "request-id")
+	multiRegionKeyARN := fmt.Sprintf("arn:aws:kms:%s:%s:key/%s", fakeRegion, fakeAccountID, multiRegionKeyID)
+
+	for _, tt := range []struct {
+		name          string
+		keyID         string
+		err           error
+		expectedKeyID string
+	}{
+		{
+			name:          "multi-region key ARN",
+			keyID:         multiRegionKeyARN,
+			err:           unavailableErr,
+			expectedKeyID: fmt.Sprintf("arn:aws:kms:us-east-1:%s:key/%s", fakeAccountID, multiRegionKeyID),
+		},
+		{
+			name:          "multi-region key id",
+			keyID:         multiRegionKeyID,
+			err:           unavailableErr,
+			expectedKeyID: multiRegionKeyID,
+		},
+		{
+			name:  "single-region key",
+			keyID: fmt.Sprintf("arn:aws:kms:%s:%s:key/%s", fakeRegion, fakeAccountID, kmsKeyID),
+			err:   unavailableErr,
+		},
+		{
+			name:  "alias",
+			keyID: spireKeyAlias,
+			err:   unavailableErr,
+		},
+		{
+			name:  "throttled",
+			keyID: multiRegionKeyARN,
+			err:   awserr.New("ThrottlingException", "rate exceeded", nil),
+		},
+		{
+			name:  "client error",
+			keyID: multiRegionKeyARN,
+			err:   awserr.New(kms.ErrCodeNotFoundException, "not found", nil),
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newKMSClientFake(t)
+			fake.setEntries([]fakeKeyEntry{
+				{KeyID: kmsKeyID, AliasName: spireKeyAlias, KeySpec: kms.CustomerMasterKeySpecEccNistP256},
+				{KeyID: multiRegionKeyID, KeySpec: kms.CustomerMasterKeySpecEccNistP256},
+			})
+			primary := &flakyKMSClient{kmsClient: fake, err: tt.err, failures: 1}
+			fallback := &recordingKeyIDClient{kmsClient: fake}
+			var fallbacks int
+			client := newFallbackClient(primary, fallback, "us-east-1", func(op, keyID string, err error) {
+				require.Equal(t, "kms:Sign", op)
+				require.Equal(t, tt.keyID, keyID)
+				fallbacks++
+			})
+
+			_, err := client.SignWithContext(ctx, &kms.SignInput{
+				KeyId:            aws.String(tt.keyID),
+				Message:          digest(crypto.SHA256, []byte("data")),
+				MessageType:      aws.String(kms.MessageTypeDigest),
+				SigningAlgorithm: aws.String(kms.SigningAlgorithmSpecEcdsaSha256),
+			})
+			if tt.expectedKeyID == "" {
+				require.Equal(t, tt.err, err)
+				require.Empty(t, fallback.keyIDs())
+				require.Zero(t, fallbacks)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, []string{tt.expectedKeyID}, fallback.keyIDs())
+			require.Equal(t, 1, fallbacks)
+		})
+	}
+}
+
+func TestFallbackRegion(t *testing.T) {
+	keyARN := fmt.Sprintf("arn:aws:kms:%s:%s:key/%s", fakeRegion, fakeAccountID, multiRegionKeyID)
+	fake := newKMSClientFake(t)
+	fake.setEntries([]fakeKeyEntry{
+		{KeyID: multiRegionKeyID, KeySpec: kms.CustomerMasterKeySpecEccNistP256},
+	})
+
+	// The primary region is down, so the managed key is only reachable in
+	// the fallback region
+	primary := &unavailableRegionClient{kmsClient: fake}
+	fallback := &recordingKeyIDClient{kmsClient: fake}
+	p := newPlugin(func(c *Config) (kmsClient, error) {
+		if c.Region == "us-east-1" {
+			return fallback, nil
+		}
+		return primary, nil
+	})
+	logs := new(logBuffer)
+	p.SetLogger(hclog.New(&hclog.LoggerOptions{
+		Output:     logs,
+		Level:      hclog.Warn,
+		JSONFormat: true,
+	}))
+	_, err := p.Configure(ctx, &plugin.ConfigureRequest{
+		Configuration: fmt.Sprintf(`{"region": "%s", "fallback_region": "us-east-1", "max_retries": 0, "key_policy": "{}", "managed_keys": {%q: %q}}`, validRegion, spireKeyID, keyARN),
+	})
+	require.NoError(t, err)
+
+	_, err = p.SignData(ctx, &keymanager.SignDataRequest{
+		KeyId:      spireKeyID,
+		Data:       digest(crypto.SHA256, []byte("data")),
+		SignerOpts: hashAlgorithmOpts(keymanager.HashAlgorithm_SHA256),
+	})
+	require.NoError(t, err)
+
+	fallbackARN := fmt.Sprintf("arn:aws:kms:us-east-1:%s:key/%s", fakeAccountID, multiRegionKeyID)
+	require.Equal(t, []string{fallbackARN, fallbackARN, fallbackARN}, fallback.keyIDs())
+	require.True(t, logs.hasFields("Calling KMS in the fallback region", map[string]string{"operation": "kms:Sign", "region": "us-east-1"}))
+}
+
+// unavailableRegionClient fails the read operations like an unavailable
+// region
+type unavailableRegionClient struct {
+	kmsClient
+}
+
+func (c *unavailableRegionClient) err() error {
+	return awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "unavailable", nil), 503, "request-id")
+}
+
+func (c *unavailableRegionClient) DescribeKeyWithContext(ctx aws.Context, input *kms.DescribeKeyInput, opts ...request.Option) (*kms.DescribeKeyOutput, error) {
+	return nil, c.err()
+}
+
+func (c *unavailableRegionClient) GetPublicKeyWithContext(ctx aws.Context, input *kms.GetPublicKeyInput, opts ...request.Option) (*kms.GetPublicKeyOutput, error) {
+	return nil, c.err()
+}
+
+func (c *unavailableRegionClient) SignWithContext(ctx aws.Context, input *kms.SignInput, opts ...request.Option) (*kms.SignOutput, error) {
+	return nil, c.err()
+}
+
+// recordingKeyIDClient records the key ids of the read operations
+type recordingKeyIDClient struct {
+	kmsClient
+
+	mu  sync.Mutex
+	ids []string
+}
+
+func (c *recordingKeyIDClient) record(keyID *string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ids = append(c.ids, aws.StringValue(keyID))
+}
+
+func (c *recordingKeyIDClient) keyIDs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ids
+}
+
+func (c *recordingKeyIDClient) DescribeKeyWithContext(ctx aws.Context, input *kms.DescribeKeyInput, opts ...request.Option) (*kms.DescribeKeyOutput, error) {
+	c.record(input.KeyId)
+	return c.kmsClient.DescribeKeyWithContext(ctx, input, opts...)
+}
+
+func (c *recordingKeyIDClient) GetPublicKeyWithContext(ctx aws.Context, input *kms.GetPublicKeyInput, opts ...request.Option) (*kms.GetPublicKeyOutput, error) {
+	c.record(input.KeyId)
+	return c.kmsClient.GetPublicKeyWithContext(ctx, input, opts...)
+}
+
+func (c *recordingKeyIDClient) SignWithContext(ctx aws.Context, input *kms.SignInput, opts ...request.Option) (*kms.SignOutput, error) {
+	c.record(input.KeyId)
+	return c.kmsClient.SignWithContext(ctx, input, opts...)
+}
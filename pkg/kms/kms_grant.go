@@ -0,0 +1,60 @@
+package kms
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// grantOperations are granted to the grantee of the created keys
+var grantOperations = []string{
+	kms.GrantOperationSign,
+	kms.GrantOperationGetPublicKey,
+}
+
+// createGrant lets grantPrincipal sign with a created key, for setups that
+// manage access with grants rather than key policies. The server itself is
+// the retiring principal, so that it can retire the grant when the key is
+// deleted.
+func (p *Plugin) createGrant(ctx context.Context, spireKeyID, kmsKeyID string) error {
+	grantResp, err := p.kmsClient.CreateGrantWithContext(ctx, &kms.CreateGrantInput{
+		KeyId:             aws.String(kmsKeyID),
+		GranteePrincipal:  aws.String(p.grantPrincipal),
+		RetiringPrincipal: aws.String(p.serverPrincipal),
+		Operations:        aws.StringSlice(grantOperations),
+	})
+	if err != nil {
+		return kmsErr.New("failed to create grant for key %q: %w", spireKeyID, withDeniedAction(err, "kms:CreateGrant", kmsKeyID))
+	}
+
+	p.mu.Lock()
+	p.grants[kmsKeyID] = aws.StringValue(grantResp.GrantId)
+	p.mu.Unlock()
+
+	p.log.Debug("Grant created", spireKeyIDTag, spireKeyID, keyIDTag, kmsKeyID, "grant_id", aws.StringValue(grantResp.GrantId))
+	return nil
+}
+
+// retireGrant retires the grant created for a key that is being deleted.
+// Only the grants created since the plugin started are known; the grants of
+// older keys become unusable with their key anyway.
+func (p *Plugin) retireGrant(ctx context.Context, spireKeyID, kmsKeyID string) {
+	p.mu.Lock()
+	grantID, ok := p.grants[kmsKeyID]
+	delete(p.grants, kmsKeyID)
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	_, err := p.kmsClient.RetireGrantWithContext(ctx, &kms.RetireGrantInput{
+		KeyId:   aws.String(kmsKeyID),
+		GrantId: aws.String(grantID),
+	})
+	if err != nil {
+		p.log.Error("It was not possible to retire grant for key", "error", wrapAWSErr("kms:RetireGrant", err), spireKeyIDTag, spireKeyID, keyIDTag, kmsKeyID, "grant_id", grantID)
+		return
+	}
+	p.log.Debug("Grant retired", spireKeyIDTag, spireKeyID, keyIDTag, kmsKeyID, "grant_id", grantID)
+}
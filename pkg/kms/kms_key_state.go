@@ -0,0 +1,83 @@
+package kms
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// DisableKey disables the current key of the given id in KMS, e.g. because
+// it was compromised, without deleting it. SignData refuses the key until
+// EnableKey is called or a new key is generated.
+func (p *Plugin) DisableKey(ctx context.Context, spireKeyID string) error {
+	if err := p.checkConfigured(); err != nil {
+		return err
+	}
+	if p.managedKeys != nil {
+		return kmsErr.New("managed keys are enabled and disabled outside of the plugin")
+	}
+	entry, ok := p.entry(spireKeyID)
+	if !ok {
+		return kmsErr.New("no such key %q", spireKeyID)
+	}
+
+	_, err := p.kmsClient.DisableKeyWithContext(ctx, &kms.DisableKeyInput{KeyId: aws.String(entry.KMSKeyID)})
+	if err != nil {
+		return kmsErr.New("failed to disable key %q: %w", spireKeyID, withDeniedAction(err, "kms:DisableKey", entry.KMSKeyID))
+	}
+	p.describeCache.forget(entry.KMSKeyID)
+
+	p.mu.Lock()
+	if current, ok := p.entries[spireKeyID]; ok && current.KMSKeyID == entry.KMSKeyID {
+		current.Disabled = true
+		p.entries[spireKeyID] = current
+	}
+	p.mu.Unlock()
+
+	p.log.Warn("Key disabled", spireKeyIDTag, spireKeyID, keyIDTag, entry.KMSKeyID)
+	return nil
+}
+
+// EnableKey enables the key of the given id again. The key is found through
+// its alias, since disabled keys are not loaded when the plugin starts.
+func (p *Plugin) EnableKey(ctx context.Context, spireKeyID string) error {
+	if err := p.checkConfigured(); err != nil {
+		return err
+	}
+	if p.managedKeys != nil {
+		return kmsErr.New("managed keys are enabled and disabled outside of the plugin")
+	}
+	alias := p.aliasFromSpireKeyID(spireKeyID)
+
+	describeResp, err := p.kmsClient.DescribeKeyWithContext(ctx, &kms.DescribeKeyInput{KeyId: aws.String(alias)})
+	switch {
+	case isAWSErrorCode(err, kms.ErrCodeNotFoundException):
+		return kmsErr.New("no such key %q", spireKeyID)
+	case err != nil:
+		return kmsErr.New("failed to describe key %q: %w", spireKeyID, withDeniedAction(err, "kms:DescribeKey", alias))
+	}
+	if err := validateKeyMetadata(describeResp.KeyMetadata); err != nil {
+		return kmsErr.New("failed to describe key %q: %v", spireKeyID, err)
+	}
+	kmsKeyID := aws.StringValue(describeResp.KeyMetadata.KeyId)
+
+	_, err = p.kmsClient.EnableKeyWithContext(ctx, &kms.EnableKeyInput{KeyId: aws.String(kmsKeyID)})
+	if err != nil {
+		return kmsErr.New("failed to enable key %q: %w", spireKeyID, withDeniedAction(err, "kms:EnableKey", kmsKeyID))
+	}
+	p.describeCache.forget(kmsKeyID)
+
+	// The entry is loaded again, in case it was dropped while disabled
+	entry, err := p.reloadEntry(ctx, spireKeyID, keyEntry{Alias: alias})
+	if err != nil {
+		return err
+	}
+	if _, _, err := p.replaceEntry(spireKeyID, entry); err != nil {
+		return err
+	}
+	p.saveCacheFile()
+
+	p.log.Info("Key enabled", spireKeyIDTag, spireKeyID, keyIDTag, kmsKeyID)
+	return nil
+}
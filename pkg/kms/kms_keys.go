@@ -0,0 +1,40 @@
+package kms
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// KeyInfo links a SPIRE key id to the KMS key backing it, e.g. to find the
+// calls made with a key in CloudTrail
+type KeyInfo struct {
+	SpireKeyID string
+	KMSKeyID   string
+	Alias      string
+	KeySpec    string
+	// Fingerprint is the hex encoded SHA-256 of the PKIX public key
+	Fingerprint string
+}
+
+// Keys returns the keys currently in use, sorted by SPIRE key id
+func (p *Plugin) Keys() []KeyInfo {
+	var keys []KeyInfo
+	p.rangeEntries(func(spireKeyID string, entry *keyEntry) bool {
+		// Entries only hold keys of the types KMS supports
+		keySpec, _ := keySpecFromKeyType(entry.PublicKey.Type)
+		keys = append(keys, KeyInfo{
+			SpireKeyID:  spireKeyID,
+			KMSKeyID:    entry.KMSKeyID,
+			Alias:       entry.Alias,
+			KeySpec:     keySpec,
+			Fingerprint: publicKeyFingerprint(entry.PublicKey.PkixData),
+		})
+		return true
+	})
+	return keys
+}
+
+func publicKeyFingerprint(pkixData []byte) string {
+	sum := sha256.Sum256(pkixData)
+	return hex.EncodeToString(sum[:])
+}
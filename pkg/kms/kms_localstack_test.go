@@ -0,0 +1,72 @@
+package kms
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spiffe/spire/pkg/server/plugin/keymanager"
+	"github.com/spiffe/spire/proto/spire/common/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+// localStackEndpointEnv points the end-to-end test at a running LocalStack
+// KMS endpoint, e.g. http://localhost:4566. The test is skipped when unset.
+const localStackEndpointEnv = "KMS_LOCALSTACK_ENDPOINT"
+
+func TestLocalStack(t *testing.T) {
+	endpoint := os.Getenv(localStackEndpointEnv)
+	if endpoint == "" {
+		t.Skipf("%s is not set", localStackEndpointEnv)
+	}
+
+	// STS is not reached through the LocalStack endpoint, so the key policy
+	// can't be generated from the caller identity
+	keyPolicy, err := newKeyPolicy("arn:aws:iam::000000000000:user/test")
+	require.NoError(t, err)
+
+	p := New()
+	_, err = p.Configure(ctx, &plugin.ConfigureRequest{
+		Configuration: fmt.Sprintf(`{
+			"access_key_id": "test",
+			"secret_access_key": "test",
+			"region": "us-east-1",
+			"key_prefix": "SPIRE_E2E_%d/",
+			"kms_endpoint": "%s",
+			"key_policy": %q
+		}`, time.Now().UnixNano(), endpoint, keyPolicy),
+	})
+	require.NoError(t, err)
+
+	for _, keyType := range []keymanager.KeyType{
+		keymanager.KeyType_EC_P256,
+		keymanager.KeyType_EC_P384,
+		keymanager.KeyType_RSA_2048,
+	} {
+		keyType := keyType
+		t.Run(keyType.String(), func(t *testing.T) {
+			keyID := keyType.String()
+
+			generateResp, err := p.GenerateKey(ctx, &keymanager.GenerateKeyRequest{
+				KeyId:   keyID,
+				KeyType: keyType,
+			})
+			require.NoError(t, err)
+			require.NotNil(t, generateResp.PublicKey)
+
+			data := digest(crypto.SHA256, []byte("data"))
+			signResp, err := p.SignData(ctx, &keymanager.SignDataRequest{
+				KeyId:      keyID,
+				Data:       data,
+				SignerOpts: hashAlgorithmOpts(keymanager.HashAlgorithm_SHA256),
+			})
+			require.NoError(t, err)
+
+			ps := &KmsPluginSuite{}
+			ps.SetT(t)
+			ps.verifySignature(generateResp.PublicKey.PkixData, crypto.SHA256, data, signResp.Signature, false)
+		})
+	}
+}
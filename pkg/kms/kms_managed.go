@@ -0,0 +1,105 @@
+package kms
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/spiffe/spire/proto/spire/server/keymanager"
+)
+
+// Managed keys are provisioned outside of SPIRE (e.g. with Terraform) and
+// adopted by the plugin, which neither creates, tags nor deletes keys then.
+// They have no alias and are addressed by their ARN.
+
+// loadManagedKeys builds the entries of the managed keys. Unlike discovered
+// keys, a managed key that can't be used is an error, since it was configured
+// explicitly.
+func (p *Plugin) loadManagedKeys(ctx context.Context, entries map[string]keyEntry) error {
+	for spireKeyID, keyARN := range p.managedKeys {
+		entry, err := p.buildManagedKeyEntry(ctx, spireKeyID, keyARN)
+		if err != nil {
+			return err
+		}
+		entries[spireKeyID] = *entry
+	}
+	return nil
+}
+
+func (p *Plugin) buildManagedKeyEntry(ctx context.Context, spireKeyID, keyARN string) (*keyEntry, error) {
+	metadata, err := p.describeKey(ctx, keyARN)
+	if err != nil {
+		return nil, kmsErr.New("failed to describe managed key %q (%s): %w", spireKeyID, keyARN, withDeniedAction(err, "kms:DescribeKey", keyARN))
+	}
+	if keyState := aws.StringValue(metadata.KeyState); keyState != kms.KeyStateEnabled {
+		return nil, kmsErr.New("managed key %q (%s) is not enabled: %s", spireKeyID, keyARN, keyState)
+	}
+	if err := checkKeyUsage(aws.StringValue(metadata.KeyUsage)); err != nil {
+		return nil, kmsErr.New("managed key %q (%s) can't be used: %v", spireKeyID, keyARN, err)
+	}
+	keyType, err := keyTypeFromKeySpec(aws.StringValue(metadata.CustomerMasterKeySpec))
+	if err != nil {
+		return nil, kmsErr.New("managed key %q (%s) is not supported: %v", spireKeyID, keyARN, err)
+	}
+	// The key spec configured for the id is what GenerateKey is expected to
+	// return, so a key of another spec was adopted by mistake
+	if expectedKeyType, ok := p.configuredKeyType(spireKeyID); ok && expectedKeyType != keyType {
+		return nil, kmsErr.New("managed key %q (%s) is of key spec %s, but %s is configured for it", spireKeyID, keyARN, aws.StringValue(metadata.CustomerMasterKeySpec), p.configuredKeySpec(spireKeyID))
+	}
+
+	getPublicKeyResp, err := p.kmsClient.GetPublicKeyWithContext(ctx, &kms.GetPublicKeyInput{KeyId: aws.String(keyARN)})
+	if err != nil {
+		return nil, kmsErr.New("failed to get public key for managed key %q (%s): %w", spireKeyID, keyARN, withDeniedAction(err, "kms:GetPublicKey", keyARN))
+	}
+	parsedPublicKey, err := parsePublicKey(spireKeyID, getPublicKeyResp.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &keyEntry{
+		KMSKeyID:     aws.StringValue(metadata.KeyId),
+		Alias:        keyARN,
+		CreationDate: aws.TimeValue(metadata.CreationDate),
+		LoadedAt:     time.Now(),
+		PublicKey: &keymanager.PublicKey{
+			Id:       spireKeyID,
+			Type:     keyType,
+			PkixData: getPublicKeyResp.PublicKey,
+		},
+		ParsedPublicKey:   parsedPublicKey,
+		SigningAlgorithms: aws.StringValueSlice(metadata.SigningAlgorithms),
+	}
+	if err := validateEntry(spireKeyID, *entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// isKeyARN tells if s looks like the ARN of a KMS key, e.g.
+// arn:aws:kms:us-west-2:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab
+func isKeyARN(s string) bool {
+	arn := strings.SplitN(s, ":", 6)
+	return len(arn) == 6 && arn[0] == "arn" && arn[2] == "kms" && strings.HasPrefix(arn[5], "key/") && len(arn[5]) > len("key/")
+}
+
+// generateManagedKey answers GenerateKey for a managed key. Managed keys are
+// not rotated by the plugin, so the current key is returned.
+func (p *Plugin) generateManagedKey(spireKeyID string, keyType keymanager.KeyType) (*keymanager.GenerateKeyResponse, error) {
+	if _, ok := p.managedKeys[spireKeyID]; !ok {
+		return nil, kmsErr.New("key %q is not one of the managed keys", spireKeyID)
+	}
+	entry, ok := p.entry(spireKeyID)
+	if !ok {
+		return nil, kmsErr.New("managed key %q is not loaded", spireKeyID)
+	}
+	if entry.PublicKey.Type != keyType {
+		return nil, kmsErr.New("managed key %q is of type %v, %v was requested", spireKeyID, entry.PublicKey.Type, keyType)
+	}
+
+	p.log.Info("Returned managed key, which is not rotated by the plugin", spireKeyIDTag, spireKeyID, keyIDTag, entry.KMSKeyID)
+	return &keymanager.GenerateKeyResponse{
+		PublicKey: clonePublicKey(entry.PublicKey),
+	}, nil
+}
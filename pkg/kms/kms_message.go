@@ -0,0 +1,17 @@
+package kms
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/spiffe/spire/proto/spire/server/keymanager"
+)
+
+// SignMessage is like SignData, except that req.Data is the message itself,
+// which KMS hashes with the hash algorithm of req.SignerOpts. It saves
+// callers that have the message from hashing it, for messages of up to 4096
+// bytes. SPIRE itself always sends digests, through SignData.
+func (p *Plugin) SignMessage(ctx context.Context, req *keymanager.SignDataRequest) (*keymanager.SignDataResponse, error) {
+	resp, _, err := p.signData(ctx, req, kms.MessageTypeRaw, p.signatureEncoding, "")
+	return resp, err
+}
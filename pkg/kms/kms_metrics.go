@@ -0,0 +1,152 @@
+package kms
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+const (
+	operationLabel = "operation"
+	statusLabel    = "status"
+
+	statusOK    = "ok"
+	statusError = "error"
+)
+
+var (
+	callsMetricKey        = []string{"kms", "calls"}
+	callDurationMetricKey = []string{"kms", "call_duration"}
+	entriesMetricKey      = []string{"kms", "entries"}
+	refreshesMetricKey    = []string{"kms", "refreshes"}
+)
+
+// Metrics receives the measurements of the calls made to KMS. Every call
+// increments a counter and records its duration, labeled with the name of
+// the operation and its status. The number of keys tracked is set as a gauge,
+// and every successful discovery increments a counter, whose rate tells if the
+// keys are still refreshed.
+type Metrics interface {
+	IncrCounter(key []string, val float32, labels map[string]string)
+	MeasureSince(key []string, start time.Time, labels map[string]string)
+	SetGauge(key []string, val float32)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) IncrCounter([]string, float32, map[string]string)    {}
+func (nopMetrics) MeasureSince([]string, time.Time, map[string]string) {}
+func (nopMetrics) SetGauge([]string, float32)                          {}
+
+// metricsClient is a kmsClient that reports every call to the metrics. It
+// sits below retryClient, so that each attempt (and each billed request) is
+// counted.
+type metricsClient struct {
+	kmsClient
+
+	metrics Metrics
+}
+
+func newMetricsClient(client kmsClient, metrics Metrics) *metricsClient {
+	return &metricsClient{
+		kmsClient: client,
+		metrics:   metrics,
+	}
+}
+
+func (c *metricsClient) CreateGrantWithContext(ctx aws.Context, input *kms.CreateGrantInput, opts ...request.Option) (out *kms.CreateGrantOutput, err error) {
+	defer c.observe("CreateGrant", time.Now(), &err)
+	return c.kmsClient.CreateGrantWithContext(ctx, input, opts...)
+}
+
+func (c *metricsClient) CreateKeyWithContext(ctx aws.Context, input *kms.CreateKeyInput, opts ...request.Option) (out *kms.CreateKeyOutput, err error) {
+	defer c.observe("CreateKey", time.Now(), &err)
+	return c.kmsClient.CreateKeyWithContext(ctx, input, opts...)
+}
+
+func (c *metricsClient) DescribeKeyWithContext(ctx aws.Context, input *kms.DescribeKeyInput, opts ...request.Option) (out *kms.DescribeKeyOutput, err error) {
+	defer c.observe("DescribeKey", time.Now(), &err)
+	return c.kmsClient.DescribeKeyWithContext(ctx, input, opts...)
+}
+
+func (c *metricsClient) DisableKeyWithContext(ctx aws.Context, input *kms.DisableKeyInput, opts ...request.Option) (out *kms.DisableKeyOutput, err error) {
+	defer c.observe("DisableKey", time.Now(), &err)
+	return c.kmsClient.DisableKeyWithContext(ctx, input, opts...)
+}
+
+func (c *metricsClient) EnableKeyWithContext(ctx aws.Context, input *kms.EnableKeyInput, opts ...request.Option) (out *kms.EnableKeyOutput, err error) {
+	defer c.observe("EnableKey", time.Now(), &err)
+	return c.kmsClient.EnableKeyWithContext(ctx, input, opts...)
+}
+
+func (c *metricsClient) CreateAliasWithContext(ctx aws.Context, input *kms.CreateAliasInput, opts ...request.Option) (out *kms.CreateAliasOutput, err error) {
+	defer c.observe("CreateAlias", time.Now(), &err)
+	return c.kmsClient.CreateAliasWithContext(ctx, input, opts...)
+}
+
+func (c *metricsClient) UpdateAliasWithContext(ctx aws.Context, input *kms.UpdateAliasInput, opts ...request.Option) (out *kms.UpdateAliasOutput, err error) {
+	defer c.observe("UpdateAlias", time.Now(), &err)
+	return c.kmsClient.UpdateAliasWithContext(ctx, input, opts...)
+}
+
+func (c *metricsClient) DeleteAliasWithContext(ctx aws.Context, input *kms.DeleteAliasInput, opts ...request.Option) (out *kms.DeleteAliasOutput, err error) {
+	defer c.observe("DeleteAlias", time.Now(), &err)
+	return c.kmsClient.DeleteAliasWithContext(ctx, input, opts...)
+}
+
+func (c *metricsClient) GetPublicKeyWithContext(ctx aws.Context, input *kms.GetPublicKeyInput, opts ...request.Option) (out *kms.GetPublicKeyOutput, err error) {
+	defer c.observe("GetPublicKey", time.Now(), &err)
+	return c.kmsClient.GetPublicKeyWithContext(ctx, input, opts...)
+}
+
+func (c *metricsClient) ListAliasesWithContext(ctx aws.Context, input *kms.ListAliasesInput, opts ...request.Option) (out *kms.ListAliasesOutput, err error) {
+	defer c.observe("ListAliases", time.Now(), &err)
+	return c.kmsClient.ListAliasesWithContext(ctx, input, opts...)
+}
+
+func (c *metricsClient) ListKeysWithContext(ctx aws.Context, input *kms.ListKeysInput, opts ...request.Option) (out *kms.ListKeysOutput, err error) {
+	defer c.observe("ListKeys", time.Now(), &err)
+	return c.kmsClient.ListKeysWithContext(ctx, input, opts...)
+}
+
+func (c *metricsClient) ListResourceTagsWithContext(ctx aws.Context, input *kms.ListResourceTagsInput, opts ...request.Option) (out *kms.ListResourceTagsOutput, err error) {
+	defer c.observe("ListResourceTags", time.Now(), &err)
+	return c.kmsClient.ListResourceTagsWithContext(ctx, input, opts...)
+}
+
+func (c *metricsClient) RetireGrantWithContext(ctx aws.Context, input *kms.RetireGrantInput, opts ...request.Option) (out *kms.RetireGrantOutput, err error) {
+	defer c.observe("RetireGrant", time.Now(), &err)
+	return c.kmsClient.RetireGrantWithContext(ctx, input, opts...)
+}
+
+func (c *metricsClient) ScheduleKeyDeletionWithContext(ctx aws.Context, input *kms.ScheduleKeyDeletionInput, opts ...request.Option) (out *kms.ScheduleKeyDeletionOutput, err error) {
+	defer c.observe("ScheduleKeyDeletion", time.Now(), &err)
+	return c.kmsClient.ScheduleKeyDeletionWithContext(ctx, input, opts...)
+}
+
+func (c *metricsClient) SignWithContext(ctx aws.Context, input *kms.SignInput, opts ...request.Option) (out *kms.SignOutput, err error) {
+	defer c.observe("Sign", time.Now(), &err)
+	return c.kmsClient.SignWithContext(ctx, input, opts...)
+}
+
+func (c *metricsClient) TagResourceWithContext(ctx aws.Context, input *kms.TagResourceInput, opts ...request.Option) (out *kms.TagResourceOutput, err error) {
+	defer c.observe("TagResource", time.Now(), &err)
+	return c.kmsClient.TagResourceWithContext(ctx, input, opts...)
+}
+
+// observe reports a call that started at start and failed if *err is set.
+// It is deferred, hence the pointer to the named error result.
+func (c *metricsClient) observe(operation string, start time.Time, err *error) {
+	status := statusOK
+	if *err != nil {
+		status = statusError
+	}
+	labels := map[string]string{
+		operationLabel: operation,
+		statusLabel:    status,
+	}
+	c.metrics.IncrCounter(callsMetricKey, 1, labels)
+	c.metrics.MeasureSince(callDurationMetricKey, start, labels)
+}
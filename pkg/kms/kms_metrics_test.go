@@ -0,0 +1,192 @@
+package kms
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/hashicorp/go-hclog"
+	"github.com/spiffe/spire/pkg/server/plugin/keymanager"
+	"github.com/spiffe/spire/proto/spire/common/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMetrics counts the calls and durations reported per operation and
+// status, and holds the last value of each gauge
+type fakeMetrics struct {
+	mu        sync.Mutex
+	calls     map[string]float32
+	durations map[string]int
+	counters  map[string]float32
+	gauges    map[string]float32
+}
+
+func newFakeMetrics() *fakeMetrics {
+	return &fakeMetrics{
+		calls:     make(map[string]float32),
+		durations: make(map[string]int),
+		counters:  make(map[string]float32),
+		gauges:    make(map[string]float32),
+	}
+}
+
+func (m *fakeMetrics) IncrCounter(key []string, val float32, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if fmt.Sprint(key) == fmt.Sprint(callsMetricKey) {
+		m.calls[labels[operationLabel]+"/"+labels[statusLabel]] += val
+		return
+	}
+	m.counters[fmt.Sprint(key)] += val
+}
+
+func (m *fakeMetrics) MeasureSince(key []string, start time.Time, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if fmt.Sprint(key) == fmt.Sprint(callDurationMetricKey) {
+		m.durations[labels[operationLabel]+"/"+labels[statusLabel]]++
+	}
+}
+
+func (m *fakeMetrics) SetGauge(key []string, val float32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[fmt.Sprint(key)] = val
+}
+
+func (m *fakeMetrics) counter(key []string) float32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[fmt.Sprint(key)]
+}
+
+func (m *fakeMetrics) gauge(key []string) (float32, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	val, ok := m.gauges[fmt.Sprint(key)]
+	return val, ok
+}
+
+func (m *fakeMetrics) count(operation, status string) (float32, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls[operation+"/"+status], m.durations[operation+"/"+status]
+}
+
+func TestMetrics(t *testing.T) {
+	fake := newKMSClientFake(t)
+	fake.setEntries([]fakeKeyEntry{
+		{
+			KeyID:     kmsKeyID,
+			AliasName: spireKeyAlias,
+			KeySpec:   kms.CustomerMasterKeySpecEccNistP256,
+		},
+	})
+	metrics := newFakeMetrics()
+
+	p := newPlugin(func(c *Config) (kmsClient, error) {
+		return fake, nil
+	})
+	p.SetLogger(hclog.NewNullLogger())
+	p.SetMetrics(metrics)
+	_, err := p.Configure(ctx, &plugin.ConfigureRequest{
+		Configuration: fmt.Sprintf(`{"region": "%s", "max_retries": 1, "key_policy": "{}"}`, validRegion),
+	})
+	require.NoError(t, err)
+
+	calls, durations := metrics.count("ListAliases", statusOK)
+	require.Equal(t, float32(1), calls)
+	require.Equal(t, 1, durations)
+	calls, _ = metrics.count("DescribeKey", statusOK)
+	require.Equal(t, float32(1), calls)
+
+	signData := func() error {
+		_, err := p.SignData(ctx, &keymanager.SignDataRequest{
+			KeyId:      spireKeyID,
+			Data:       digest(crypto.SHA256, []byte("data")),
+			SignerOpts: hashAlgorithmOpts(keymanager.HashAlgorithm_SHA256),
+		})
+		return err
+	}
+	require.NoError(t, signData())
+	calls, durations = metrics.count("Sign", statusOK)
+	require.Equal(t, float32(1), calls)
+	require.Equal(t, 1, durations)
+
+	// An error that is not worth retrying is a single request
+	fake.signErr = errors.New("sign error")
+	require.Error(t, signData())
+	calls, durations = metrics.count("Sign", statusError)
+	require.Equal(t, float32(1), calls)
+	require.Equal(t, 1, durations)
+
+	// Every retried attempt is a request, and is counted
+	fake.signErr = awserr.New("ThrottlingException", "rate exceeded", nil)
+	require.Error(t, signData())
+	calls, _ = metrics.count("Sign", statusError)
+	require.Equal(t, float32(3), calls)
+}
+
+func TestEntryMetrics(t *testing.T) {
+	fake := newKMSClientFake(t)
+	fake.setEntries([]fakeKeyEntry{
+		{
+			KeyID:     kmsKeyID,
+			AliasName: spireKeyAlias,
+			KeySpec:   kms.CustomerMasterKeySpecEccNistP256,
+		},
+	})
+	metrics := newFakeMetrics()
+
+	p := newPlugin(func(c *Config) (kmsClient, error) {
+		return fake, nil
+	})
+	p.SetLogger(hclog.NewNullLogger())
+	p.SetMetrics(metrics)
+	requireEntries := func(expected int) {
+		entries, ok := metrics.gauge(entriesMetricKey)
+		require.True(t, ok)
+		require.Equal(t, float32(expected), entries)
+		require.Len(t, p.publicKeys(), expected)
+	}
+	requireRefreshes := func(expected int) {
+		require.Equal(t, float32(expected), metrics.counter(refreshesMetricKey))
+	}
+
+	_, err := p.Configure(ctx, &plugin.ConfigureRequest{
+		Configuration: fmt.Sprintf(`{"region": "%s", "key_policy": "{}"}`, validRegion),
+	})
+	require.NoError(t, err)
+	requireEntries(1)
+	requireRefreshes(1)
+
+	// A new key is tracked, a replaced one is not counted twice
+	for _, spireKeyID := range []string{"spireKeyID-2", "spireKeyID-2", spireKeyID} {
+		_, err = p.GenerateKey(ctx, &keymanager.GenerateKeyRequest{
+			KeyId:   spireKeyID,
+			KeyType: keymanager.KeyType_EC_P256,
+		})
+		require.NoError(t, err)
+	}
+	requireEntries(2)
+	requireRefreshes(1)
+
+	// A key deleted out-of-band is dropped by the next refresh
+	entry, ok := p.entry("spireKeyID-2")
+	require.True(t, ok)
+	fake.deleteKey(entry.KMSKeyID)
+	require.NoError(t, p.refreshEntries(ctx))
+	requireEntries(1)
+	requireRefreshes(2)
+
+	// A failed refresh is not counted
+	fake.listAliasesErr = errors.New("list aliases error")
+	require.Error(t, p.refreshEntries(ctx))
+	requireRefreshes(2)
+	requireEntries(1)
+}
@@ -0,0 +1,49 @@
+package kms
+
+import (
+	"github.com/hashicorp/go-hclog"
+)
+
+// Option customizes a plugin created with New, e.g. to embed it as a library
+// rather than run it as a SPIRE plugin
+type Option func(*Plugin)
+
+// WithLogger sets the logger of the plugin, like SetLogger
+func WithLogger(log hclog.Logger) Option {
+	return func(p *Plugin) {
+		p.SetLogger(log)
+	}
+}
+
+// WithKMSClient makes the plugin call KMS through client, e.g. a fake in
+// tests, instead of a client created from the configuration. The calls are
+// still retried and measured. The caller identity, needed when key_policy is
+// not set, is still looked up with an STS client created from the
+// configuration, unless WithSTSClient is also given.
+func WithKMSClient(client KMSClient) Option {
+	return func(p *Plugin) {
+		p.hooks.newClient = func(*Config) (kmsClient, error) {
+			return client, nil
+		}
+	}
+}
+
+// WithSTSClient makes the plugin look up its caller identity through client,
+// e.g. a fake in tests, instead of a client created from the configuration
+func WithSTSClient(client STSClient) Option {
+	return func(p *Plugin) {
+		p.hooks.newSTSClient = func(*Config) (stsClient, error) {
+			return client, nil
+		}
+	}
+}
+
+// WithConfig sets the configuration used when Configure is called with an
+// empty one, so that the plugin can be configured without HCL. It is still
+// validated and defaulted by Configure.
+func WithConfig(config *Config) Option {
+	return func(p *Plugin) {
+		c := *config
+		p.config = &c
+	}
+}
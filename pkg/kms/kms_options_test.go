@@ -0,0 +1,65 @@
+package kms
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/hashicorp/go-hclog"
+	"github.com/spiffe/spire/pkg/server/plugin/keymanager"
+	"github.com/spiffe/spire/proto/spire/common/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewWithOptions(t *testing.T) {
+	fake := newKMSClientFake(t)
+	fake.setEntries([]fakeKeyEntry{
+		{
+			KeyID:     kmsKeyID,
+			AliasName: spireKeyAlias,
+			KeySpec:   kms.CustomerMasterKeySpecEccNistP256,
+		},
+	})
+	// Without key_policy, the caller identity is looked up with the STS client
+	config := &Config{Region: validRegion}
+	log := hclog.NewNullLogger()
+	sts := &stsClientFake{arn: fmt.Sprintf("arn:aws:iam::%s:user/spire-server", fakeAccountID)}
+
+	p := New(WithKMSClient(fake), WithSTSClient(sts), WithLogger(log), WithConfig(config))
+	require.Equal(t, log, p.log)
+
+	// The configuration was copied
+	config.Region = "not-a-region"
+
+	_, err := p.Configure(ctx, &plugin.ConfigureRequest{})
+	require.NoError(t, err)
+
+	resp, err := p.GetPublicKeys(ctx, &keymanager.GetPublicKeysRequest{})
+	require.NoError(t, err)
+	require.Len(t, resp.PublicKeys, 1)
+	require.Equal(t, spireKeyID, resp.PublicKeys[0].Id)
+
+	generateResp, err := p.GenerateKey(ctx, &keymanager.GenerateKeyRequest{
+		KeyId:   "new-key",
+		KeyType: keymanager.KeyType_EC_P384,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "new-key", generateResp.PublicKey.Id)
+	require.Len(t, fake.keyEntries(), 2)
+	policy, err := p.keyPolicy()
+	require.NoError(t, err)
+	require.Contains(t, policy, sts.arn)
+
+	// A configuration from SPIRE is still used as is
+	_, err = p.Configure(ctx, &plugin.ConfigureRequest{Configuration: `{"key_policy": "{}"}`})
+	require.EqualError(t, err, "kms: configuration is missing a region")
+}
+
+func TestNewWithoutOptions(t *testing.T) {
+	p := New()
+	require.NotNil(t, p.hooks.newClient)
+	require.Nil(t, p.config)
+
+	_, err := p.Configure(ctx, &plugin.ConfigureRequest{})
+	require.EqualError(t, err, "kms: configuration is missing a region")
+}
@@ -0,0 +1,145 @@
+package kms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const keyPolicyVersion = "2012-10-17"
+
+// keyAdministrationActions are granted to the account, so that IAM policies
+// can still manage (and delete) the keys. Using the keys to sign is left out.
+var keyAdministrationActions = []string{
+	"kms:Create*",
+	"kms:Describe*",
+	"kms:Enable*",
+	"kms:List*",
+	"kms:Put*",
+	"kms:Update*",
+	"kms:Revoke*",
+	"kms:Disable*",
+	"kms:Get*",
+	"kms:Delete*",
+	"kms:TagResource",
+	"kms:UntagResource",
+	"kms:ScheduleKeyDeletion",
+	"kms:CancelKeyDeletion",
+}
+
+// keyUsageActions are granted to the principal of the SPIRE server
+var keyUsageActions = []string{
+	"kms:Sign",
+	"kms:GetPublicKey",
+	"kms:DescribeKey",
+}
+
+type keyPolicyDocument struct {
+	Version   string               `json:"Version"`
+	Statement []keyPolicyStatement `json:"Statement"`
+}
+
+type keyPolicyStatement struct {
+	Sid       string             `json:"Sid"`
+	Effect    string             `json:"Effect"`
+	Principal keyPolicyPrincipal `json:"Principal"`
+	Action    []string           `json:"Action"`
+	Resource  string             `json:"Resource"`
+}
+
+type keyPolicyPrincipal struct {
+	AWS string `json:"AWS"`
+}
+
+// keyPolicy returns the policy attached to the keys created by the plugin:
+// the configured one, or else a policy that only lets the principal of the
+// SPIRE server use the keys.
+func (p *Plugin) keyPolicy() (string, error) {
+	if p.configuredKeyPolicy != "" {
+		return p.configuredKeyPolicy, nil
+	}
+	return newKeyPolicy(p.serverPrincipal)
+}
+
+// callerPrincipal returns the principal the SPIRE server calls KMS as, when
+// it is not configured: the caller identity
+func callerPrincipal(ctx context.Context, client stsClient) (string, error) {
+	identity, err := client.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", kmsErr.New("failed to get caller identity: %w", classifyError(wrapAWSErr("sts:GetCallerIdentity", err)))
+	}
+	return principalFromCallerARN(aws.StringValue(identity.Arn)), nil
+}
+
+// newKeyPolicy returns a policy that lets the account administer the keys
+// and only the given principal use them.
+func newKeyPolicy(principal string) (string, error) {
+	arn := strings.SplitN(principal, ":", 6)
+	if len(arn) != 6 || arn[0] != "arn" || arn[4] == "" {
+		return "", kmsErr.New("invalid principal ARN %q", principal)
+	}
+	partition, account := arn[1], arn[4]
+
+	policy, err := json.Marshal(keyPolicyDocument{
+		Version: keyPolicyVersion,
+		Statement: []keyPolicyStatement{
+			{
+				Sid:       "AllowKeyAdministration",
+				Effect:    "Allow",
+				Principal: keyPolicyPrincipal{AWS: fmt.Sprintf("arn:%s:iam::%s:root", partition, account)},
+				Action:    keyAdministrationActions,
+				Resource:  "*",
+			},
+			{
+				Sid:       "AllowSPIREServer",
+				Effect:    "Allow",
+				Principal: keyPolicyPrincipal{AWS: principal},
+				Action:    keyUsageActions,
+				Resource:  "*",
+			},
+		},
+	})
+	if err != nil {
+		return "", kmsErr.New("failed to marshal key policy: %v", err)
+	}
+	return string(policy), nil
+}
+
+// principalFromCallerARN returns the ARN to use as principal for a caller
+// identity. Sessions of assumed roles are turned into the ARN of the role,
+// since the session ARN changes every time the role is assumed. The session
+// ARN lacks the path of the role, so roles with a path have to be configured
+// with server_principal_arn.
+func principalFromCallerARN(callerARN string) string {
+	arn := strings.SplitN(callerARN, ":", 6)
+	if len(arn) != 6 || arn[2] != "sts" || !strings.HasPrefix(arn[5], "assumed-role/") {
+		return callerARN
+	}
+
+	resource := strings.Split(arn[5], "/")
+	return fmt.Sprintf("arn:%s:iam::%s:role/%s", arn[1], arn[4], resource[1])
+}
+
+// loadKeyPolicy returns the key policy document set in the configuration,
+// either inline or as the path to a file holding it.
+func loadKeyPolicy(keyPolicy string) (string, error) {
+	policy := keyPolicy
+	if !strings.HasPrefix(strings.TrimSpace(keyPolicy), "{") {
+		b, err := ioutil.ReadFile(keyPolicy)
+		if err != nil {
+			return "", kmsErr.New("failed to read key policy file: %v", err)
+		}
+		policy = string(b)
+	}
+
+	var document map[string]interface{}
+	if err := json.Unmarshal([]byte(policy), &document); err != nil {
+		return "", kmsErr.New("key policy is not a valid JSON document: %v", err)
+	}
+	return policy, nil
+}
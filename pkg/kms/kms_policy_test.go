@@ -0,0 +1,116 @@
+package kms
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewKeyPolicy(t *testing.T) {
+	policy, err := newKeyPolicy("arn:aws-cn:iam::123456789012:role/spire-server")
+	require.NoError(t, err)
+
+	var document keyPolicyDocument
+	require.NoError(t, json.Unmarshal([]byte(policy), &document))
+	require.Equal(t, keyPolicyVersion, document.Version)
+	require.Len(t, document.Statement, 2)
+
+	// The account administers the keys, but only the server signs with them
+	administration := document.Statement[0]
+	require.Equal(t, "arn:aws-cn:iam::123456789012:root", administration.Principal.AWS)
+	require.Equal(t, keyAdministrationActions, administration.Action)
+	require.NotContains(t, administration.Action, "kms:Sign")
+
+	usage := document.Statement[1]
+	require.Equal(t, "arn:aws-cn:iam::123456789012:role/spire-server", usage.Principal.AWS)
+	require.Equal(t, []string{"kms:Sign", "kms:GetPublicKey", "kms:DescribeKey"}, usage.Action)
+
+	_, err = newKeyPolicy("spire-server")
+	require.EqualError(t, err, `kms: invalid principal ARN "spire-server"`)
+}
+
+func TestPrincipalFromCallerARN(t *testing.T) {
+	for _, tt := range []struct {
+		callerARN string
+		principal string
+	}{
+		{
+			callerARN: "arn:aws:iam::123456789012:user/spire-server",
+			principal: "arn:aws:iam::123456789012:user/spire-server",
+		},
+		{
+			callerARN: "arn:aws:iam::123456789012:role/spire-server",
+			principal: "arn:aws:iam::123456789012:role/spire-server",
+		},
+		{
+			callerARN: "arn:aws:sts::123456789012:assumed-role/spire-server/i-0123456789abcdef0",
+			principal: "arn:aws:iam::123456789012:role/spire-server",
+		},
+		{
+			callerARN: "arn:aws-us-gov:sts::123456789012:assumed-role/spire-server/session",
+			principal: "arn:aws-us-gov:iam::123456789012:role/spire-server",
+		},
+	} {
+		require.Equal(t, tt.principal, principalFromCallerARN(tt.callerARN), tt.callerARN)
+	}
+}
+
+func TestLoadKeyPolicy(t *testing.T) {
+	const policy = `{"Version":"2012-10-17","Statement":[]}`
+
+	dir, err := ioutil.TempDir("", "kms-key-policy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	policyPath := filepath.Join(dir, "policy.json")
+	require.NoError(t, ioutil.WriteFile(policyPath, []byte(policy), 0600))
+	malformedPath := filepath.Join(dir, "malformed.json")
+	require.NoError(t, ioutil.WriteFile(malformedPath, []byte("Version: 2012-10-17"), 0600))
+
+	for _, tt := range []struct {
+		name      string
+		keyPolicy string
+		expected  string
+		err       string
+	}{
+		{
+			name:      "inline",
+			keyPolicy: policy,
+			expected:  policy,
+		},
+		{
+			name:      "file",
+			keyPolicy: policyPath,
+			expected:  policy,
+		},
+		{
+			name:      "malformed inline",
+			keyPolicy: `{"Version":`,
+			err:       "kms: key policy is not a valid JSON document: unexpected end of JSON input",
+		},
+		{
+			name:      "malformed file",
+			keyPolicy: malformedPath,
+			err:       "kms: key policy is not a valid JSON document: invalid character 'V' looking for beginning of value",
+		},
+		{
+			name:      "missing file",
+			keyPolicy: filepath.Join(dir, "missing.json"),
+			err:       "kms: failed to read key policy file: open " + filepath.Join(dir, "missing.json") + ": no such file or directory",
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			keyPolicy, err := loadKeyPolicy(tt.keyPolicy)
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, keyPolicy)
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package kms
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+const (
+	defaultMaxRetries     = 3
+	defaultRequestTimeout = 30 * time.Second
+
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = 5 * time.Second
+)
+
+// retryClient is a kmsClient that bounds every call with a timeout, and
+// retries the calls failing because of throttling or transient errors, backing
+// off exponentially between attempts.
+type retryClient struct {
+	kmsClient
+
+	timeout    time.Duration
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+}
+
+func newRetryClient(client kmsClient, timeout time.Duration, maxRetries int) *retryClient {
+	return &retryClient{
+		kmsClient:  client,
+		timeout:    timeout,
+		maxRetries: maxRetries,
+		baseDelay:  retryBaseDelay,
+		maxDelay:   retryMaxDelay,
+	}
+}
+
+func (c *retryClient) CreateGrantWithContext(ctx aws.Context, input *kms.CreateGrantInput, opts ...request.Option) (out *kms.CreateGrantOutput, err error) {
+	err = c.retry(ctx, func(ctx aws.Context) error {
+		out, err = c.kmsClient.CreateGrantWithContext(ctx, input, opts...)
+		return err
+	})
+	return out, err
+}
+
+// CreateKeyWithContext retries CreateKey like the other calls, and also after
+// a timeout, but KMS doesn't deduplicate the created keys: an attempt whose
+// outcome is unknown may still have created one. When the input is tagged with
+// a request id, the key tagged with it is looked up before trying again after
+// such an attempt.
+func (c *retryClient) CreateKeyWithContext(ctx aws.Context, input *kms.CreateKeyInput, opts ...request.Option) (out *kms.CreateKeyOutput, err error) {
+	requestID := tagValue(input.Tags, requestIDTagKey)
+	// maybeCreated is set once an attempt may have created the key, and
+	// timedOut when the last attempt timed out
+	maybeCreated, timedOut := false, false
+	retryable := func(err error) bool {
+		return timedOut || isRetryableError(err)
+	}
+	err = c.retryWhen(ctx, retryable, func(ctx aws.Context) error {
+		timedOut = false
+		if maybeCreated && requestID != "" {
+			out, err = c.findCreatedKey(ctx, requestID)
+			if err != nil || out != nil {
+				return err
+			}
+		}
+		out, err = c.kmsClient.CreateKeyWithContext(ctx, input, opts...)
+		if err != nil && isUnknownOutcomeError(ctx, err) {
+			maybeCreated = true
+			timedOut = ctx.Err() == context.DeadlineExceeded
+		}
+		return err
+	})
+	return out, err
+}
+
+// findCreatedKey returns the key tagged with the given request id, or nil if
+// there is none. It lists every key of the account, which is only acceptable
+// because CreateKey is rarely retried. A key whose tags can't be listed fails
+// the lookup, since it may be the one created.
+func (c *retryClient) findCreatedKey(ctx aws.Context, requestID string) (*kms.CreateKeyOutput, error) {
+	var marker *string
+	for {
+		keysResp, err := c.kmsClient.ListKeysWithContext(ctx, &kms.ListKeysInput{Marker: marker})
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keysResp.Keys {
+			tagsResp, err := c.kmsClient.ListResourceTagsWithContext(ctx, &kms.ListResourceTagsInput{KeyId: key.KeyId})
+			if err != nil {
+				return nil, err
+			}
+			if tagValue(tagsResp.Tags, requestIDTagKey) != requestID {
+				continue
+			}
+			describeResp, err := c.kmsClient.DescribeKeyWithContext(ctx, &kms.DescribeKeyInput{KeyId: key.KeyId})
+			if err != nil {
+				return nil, err
+			}
+			return &kms.CreateKeyOutput{KeyMetadata: describeResp.KeyMetadata}, nil
+		}
+		if keysResp.NextMarker == nil {
+			return nil, nil
+		}
+		marker = keysResp.NextMarker
+	}
+}
+
+func tagValue(tags []*kms.Tag, key string) string {
+	for _, tag := range tags {
+		if aws.StringValue(tag.TagKey) == key {
+			return aws.StringValue(tag.TagValue)
+		}
+	}
+	return ""
+}
+
+type requestIDContextKey struct{}
+
+// ContextWithRequestID returns a context that makes GenerateKey tag the key it
+// creates with requestID, instead of a random id, so that a caller retrying
+// GenerateKey can tell which call created a key
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, requestID)
+}
+
+// requestIDFromContext returns the request id set by ContextWithRequestID, if
+// any
+func requestIDFromContext(ctx context.Context) (string, bool) {
+	requestID, ok := ctx.Value(requestIDContextKey{}).(string)
+	return requestID, ok && requestID != ""
+}
+
+// newRequestID returns a random id for the tag of a created key
+func newRequestID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := cryptorand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (c *retryClient) DescribeKeyWithContext(ctx aws.Context, input *kms.DescribeKeyInput, opts ...request.Option) (out *kms.DescribeKeyOutput, err error) {
+	err = c.retry(ctx, func(ctx aws.Context) error {
+		out, err = c.kmsClient.DescribeKeyWithContext(ctx, input, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *retryClient) DisableKeyWithContext(ctx aws.Context, input *kms.DisableKeyInput, opts ...request.Option) (out *kms.DisableKeyOutput, err error) {
+	err = c.retry(ctx, func(ctx aws.Context) error {
+		out, err = c.kmsClient.DisableKeyWithContext(ctx, input, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *retryClient) EnableKeyWithContext(ctx aws.Context, input *kms.EnableKeyInput, opts ...request.Option) (out *kms.EnableKeyOutput, err error) {
+	err = c.retry(ctx, func(ctx aws.Context) error {
+		out, err = c.kmsClient.EnableKeyWithContext(ctx, input, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *retryClient) CreateAliasWithContext(ctx aws.Context, input *kms.CreateAliasInput, opts ...request.Option) (out *kms.CreateAliasOutput, err error) {
+	err = c.retry(ctx, func(ctx aws.Context) error {
+		out, err = c.kmsClient.CreateAliasWithContext(ctx, input, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *retryClient) UpdateAliasWithContext(ctx aws.Context, input *kms.UpdateAliasInput, opts ...request.Option) (out *kms.UpdateAliasOutput, err error) {
+	err = c.retry(ctx, func(ctx aws.Context) error {
+		out, err = c.kmsClient.UpdateAliasWithContext(ctx, input, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *retryClient) DeleteAliasWithContext(ctx aws.Context, input *kms.DeleteAliasInput, opts ...request.Option) (out *kms.DeleteAliasOutput, err error) {
+	err = c.retry(ctx, func(ctx aws.Context) error {
+		out, err = c.kmsClient.DeleteAliasWithContext(ctx, input, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *retryClient) GetPublicKeyWithContext(ctx aws.Context, input *kms.GetPublicKeyInput, opts ...request.Option) (out *kms.GetPublicKeyOutput, err error) {
+	err = c.retry(ctx, func(ctx aws.Context) error {
+		out, err = c.kmsClient.GetPublicKeyWithContext(ctx, input, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *retryClient) ListAliasesWithContext(ctx aws.Context, input *kms.ListAliasesInput, opts ...request.Option) (out *kms.ListAliasesOutput, err error) {
+	err = c.retry(ctx, func(ctx aws.Context) error {
+		out, err = c.kmsClient.ListAliasesWithContext(ctx, input, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *retryClient) ListKeysWithContext(ctx aws.Context, input *kms.ListKeysInput, opts ...request.Option) (out *kms.ListKeysOutput, err error) {
+	err = c.retry(ctx, func(ctx aws.Context) error {
+		out, err = c.kmsClient.ListKeysWithContext(ctx, input, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *retryClient) ListResourceTagsWithContext(ctx aws.Context, input *kms.ListResourceTagsInput, opts ...request.Option) (out *kms.ListResourceTagsOutput, err error) {
+	err = c.retry(ctx, func(ctx aws.Context) error {
+		out, err = c.kmsClient.ListResourceTagsWithContext(ctx, input, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *retryClient) RetireGrantWithContext(ctx aws.Context, input *kms.RetireGrantInput, opts ...request.Option) (out *kms.RetireGrantOutput, err error) {
+	err = c.retry(ctx, func(ctx aws.Context) error {
+		out, err = c.kmsClient.RetireGrantWithContext(ctx, input, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *retryClient) ScheduleKeyDeletionWithContext(ctx aws.Context, input *kms.ScheduleKeyDeletionInput, opts ...request.Option) (out *kms.ScheduleKeyDeletionOutput, err error) {
+	err = c.retry(ctx, func(ctx aws.Context) error {
+		out, err = c.kmsClient.ScheduleKeyDeletionWithContext(ctx, input, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *retryClient) SignWithContext(ctx aws.Context, input *kms.SignInput, opts ...request.Option) (out *kms.SignOutput, err error) {
+	err = c.retry(ctx, func(ctx aws.Context) error {
+		out, err = c.kmsClient.SignWithContext(ctx, input, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *retryClient) TagResourceWithContext(ctx aws.Context, input *kms.TagResourceInput, opts ...request.Option) (out *kms.TagResourceOutput, err error) {
+	err = c.retry(ctx, func(ctx aws.Context) error {
+		out, err = c.kmsClient.TagResourceWithContext(ctx, input, opts...)
+		return err
+	})
+	return out, err
+}
+
+// retry calls fn until it succeeds, fails with an error that is not worth
+// retrying, or the retries are exhausted. The last error is returned. Each
+// attempt gets a context derived from ctx that expires after the timeout.
+func (c *retryClient) retry(ctx aws.Context, fn func(aws.Context) error) error {
+	return c.retryWhen(ctx, isRetryableError, fn)
+}
+
+// retryWhen is retry with the errors worth retrying told by retryable
+func (c *retryClient) retryWhen(ctx aws.Context, retryable func(error) bool, fn func(aws.Context) error) error {
+	delay := c.baseDelay
+	for attempt := 0; ; attempt++ {
+		err := c.call(ctx, fn)
+		if err == nil || attempt >= c.maxRetries || !retryable(err) {
+			return err
+		}
+
+		// Half of the delay is randomized so that servers throttled at the
+		// same time don't retry in lockstep.
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+
+		delay *= 2
+		if delay > c.maxDelay {
+			delay = c.maxDelay
+		}
+	}
+}
+
+// call makes a single attempt, bounded by the request timeout. Cancelling
+// ctx still cancels the attempt.
+func (c *retryClient) call(ctx aws.Context, fn func(aws.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return fn(ctx)
+}
+
+// isRetryableError returns true for throttling and transient errors, which
+// are likely to succeed if the call is made again. Only AWS errors are: the
+// SDK deems any other error retryable, including cancelled contexts.
+func isRetryableError(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	if request.IsErrorThrottle(aerr) || request.IsErrorRetryable(aerr) {
+		return true
+	}
+
+	switch aerr.Code() {
+	case kms.ErrCodeInternalException,
+		kms.ErrCodeKeyUnavailableException,
+		kms.ErrCodeDependencyTimeoutException:
+		return true
+	}
+
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		return reqErr.StatusCode() >= 500
+	}
+	return false
+}
+
+// isUnknownOutcomeError tells if a call that failed with err, made with ctx,
+// may still have been carried out by KMS: it timed out, or failed on the
+// server side or the network. A throttled or rejected call was not.
+func isUnknownOutcomeError(ctx aws.Context, err error) bool {
+	return ctx.Err() == context.DeadlineExceeded || isRegionUnavailableError(err)
+}
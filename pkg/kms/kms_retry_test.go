@@ -0,0 +1,458 @@
+package kms
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/hashicorp/go-hclog"
+	"github.com/spiffe/spire/pkg/server/plugin/keymanager"
+	"github.com/spiffe/spire/proto/spire/common/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyKMSClient fails the first calls to Sign with err
+type flakyKMSClient struct {
+	kmsClient
+
+	err      error
+	failures int
+	calls    int
+}
+
+func (c *flakyKMSClient) SignWithContext(ctx aws.Context, input *kms.SignInput, opts ...request.Option) (*kms.SignOutput, error) {
+	c.calls++
+	if c.calls <= c.failures {
+		return nil, c.err
+	}
+	return c.kmsClient.SignWithContext(ctx, input, opts...)
+}
+
+func TestRetryClient(t *testing.T) {
+	throttlingErr := awserr.New("ThrottlingException", "rate exceeded", nil)
+
+	for _, tt := range []struct {
+		name          string
+		err           error
+		failures      int
+		maxRetries    int
+		expectedErr   string
+		expectedCalls int
+	}{
+		{
+			name:          "no failures",
+			maxRetries:    3,
+			expectedCalls: 1,
+		},
+		{
+			name:          "throttled then succeeds",
+			err:           throttlingErr,
+			failures:      3,
+			maxRetries:    3,
+			expectedCalls: 4,
+		},
+		{
+			name:          "server error then succeeds",
+			err:           awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "unavailable", nil), 503, "request-id"),
+			failures:      1,
+			maxRetries:    3,
+			expectedCalls: 2,
+		},
+		{
+			name:          "retries exhausted",
+			err:           throttlingErr,
+			failures:      4,
+			maxRetries:    3,
+			expectedErr:   "ThrottlingException: rate exceeded",
+			expectedCalls: 4,
+		},
+		{
+			name:          "error not retried",
+			err:           awserr.New(kms.ErrCodeNotFoundException, "not found", nil),
+			failures:      1,
+			maxRetries:    3,
+			expectedErr:   "NotFoundException: not found",
+			expectedCalls: 1,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newKMSClientFake(t)
+			fake.setEntries([]fakeKeyEntry{
+				{
+					KeyID:   kmsKeyID,
+					KeySpec: kms.CustomerMasterKeySpecEccNistP256,
+				},
+			})
+			flaky := &flakyKMSClient{kmsClient: fake, err: tt.err, failures: tt.failures}
+			client := newRetryClient(flaky, time.Minute, tt.maxRetries)
+			client.baseDelay = time.Millisecond
+
+			resp, err := client.SignWithContext(context.Background(), &kms.SignInput{
+				KeyId:            aws.String(kmsKeyID),
+				Message:          digest(crypto.SHA256, []byte("data")),
+				MessageType:      aws.String(kms.MessageTypeDigest),
+				SigningAlgorithm: aws.String(kms.SigningAlgorithmSpecEcdsaSha256),
+			})
+			require.Equal(t, tt.expectedCalls, flaky.calls)
+			if tt.expectedErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.NotEmpty(t, resp.Signature)
+		})
+	}
+}
+
+func TestRetryClientStopsWhenContextIsDone(t *testing.T) {
+	flaky := &flakyKMSClient{
+		kmsClient: newKMSClientFake(t),
+		err:       awserr.New("ThrottlingException", "rate exceeded", nil),
+		failures:  10,
+	}
+	client := newRetryClient(flaky, time.Minute, 10)
+	client.baseDelay = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := client.SignWithContext(ctx, &kms.SignInput{KeyId: aws.String(kmsKeyID)})
+	require.Error(t, err)
+	require.Equal(t, 1, flaky.calls)
+}
+
+// slowKMSClient blocks Sign until the call context is done
+type slowKMSClient struct {
+	kmsClient
+}
+
+func (c *slowKMSClient) SignWithContext(ctx aws.Context, input *kms.SignInput, opts ...request.Option) (*kms.SignOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestRetryClientTimesOutCalls(t *testing.T) {
+	client := newRetryClient(&slowKMSClient{kmsClient: newKMSClientFake(t)}, 10*time.Millisecond, 0)
+
+	_, err := client.SignWithContext(context.Background(), &kms.SignInput{KeyId: aws.String(kmsKeyID)})
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	// Cancelling the parent context still cancels the call
+	client.timeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = client.SignWithContext(ctx, &kms.SignInput{KeyId: aws.String(kmsKeyID)})
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestSignDataTimesOut(t *testing.T) {
+	fake := newKMSClientFake(t)
+	fake.setEntries([]fakeKeyEntry{
+		{
+			KeyID:     kmsKeyID,
+			AliasName: spireKeyAlias,
+			KeySpec:   kms.CustomerMasterKeySpecEccNistP256,
+		},
+	})
+
+	p := newPlugin(func(c *Config) (kmsClient, error) {
+		return &slowKMSClient{kmsClient: fake}, nil
+	})
+	p.SetLogger(hclog.NewNullLogger())
+	_, err := p.Configure(ctx, &plugin.ConfigureRequest{
+		Configuration: fmt.Sprintf(`{"region": "%s", "request_timeout": "10ms", "key_policy": "{}"}`, validRegion),
+	})
+	require.NoError(t, err)
+
+	_, err = p.SignData(ctx, &keymanager.SignDataRequest{
+		KeyId:      spireKeyID,
+		Data:       digest(crypto.SHA256, []byte("data")),
+		SignerOpts: hashAlgorithmOpts(keymanager.HashAlgorithm_SHA256),
+	})
+	require.EqualError(t, err, `kms: failed to sign data with key "spireKeyID": context deadline exceeded`)
+}
+
+func TestSignDataRetriesThrottledCalls(t *testing.T) {
+	fake := newKMSClientFake(t)
+	fake.setEntries([]fakeKeyEntry{
+		{
+			KeyID:     kmsKeyID,
+			AliasName: spireKeyAlias,
+			KeySpec:   kms.CustomerMasterKeySpecEccNistP256,
+		},
+	})
+	flaky := &flakyKMSClient{
+		kmsClient: fake,
+		err:       awserr.New("ThrottlingException", "rate exceeded", nil),
+		failures:  2,
+	}
+
+	p := newPlugin(func(c *Config) (kmsClient, error) {
+		return flaky, nil
+	})
+	p.SetLogger(hclog.NewNullLogger())
+	_, err := p.Configure(ctx, &plugin.ConfigureRequest{
+		Configuration: fmt.Sprintf(`{"region": "%s", "max_retries": 2, "key_policy": "{}"}`, validRegion),
+	})
+	require.NoError(t, err)
+
+	resp, err := p.SignData(ctx, &keymanager.SignDataRequest{
+		KeyId:      spireKeyID,
+		Data:       digest(crypto.SHA256, []byte("data")),
+		SignerOpts: hashAlgorithmOpts(keymanager.HashAlgorithm_SHA256),
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, resp.Signature)
+	require.Equal(t, 3, flaky.calls)
+}
+
+func TestMaxRetries(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		maxRetries    string
+		expectedCalls int
+	}{
+		{name: "default", expectedCalls: 4},
+		{name: "disabled", maxRetries: `, "max_retries": 0`, expectedCalls: 1},
+		{name: "set", maxRetries: `, "max_retries": 1`, expectedCalls: 2},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newKMSClientFake(t)
+			fake.setEntries([]fakeKeyEntry{
+				{
+					KeyID:     kmsKeyID,
+					AliasName: spireKeyAlias,
+					KeySpec:   kms.CustomerMasterKeySpecEccNistP256,
+				},
+			})
+			flaky := &flakyKMSClient{
+				kmsClient: fake,
+				err:       awserr.New("ThrottlingException", "rate exceeded", nil),
+				failures:  10,
+			}
+			p := newPlugin(func(c *Config) (kmsClient, error) {
+				return flaky, nil
+			})
+			p.SetLogger(hclog.NewNullLogger())
+			_, err := p.Configure(ctx, &plugin.ConfigureRequest{
+				Configuration: fmt.Sprintf(`{"region": "%s", "key_policy": "{}"%s}`, validRegion, tt.maxRetries),
+			})
+			require.NoError(t, err)
+			p.kmsClient.(*retryClient).baseDelay = time.Millisecond
+
+			_, err = p.SignData(ctx, &keymanager.SignDataRequest{
+				KeyId:      spireKeyID,
+				Data:       digest(crypto.SHA256, []byte("data")),
+				SignerOpts: hashAlgorithmOpts(keymanager.HashAlgorithm_SHA256),
+			})
+			require.Error(t, err)
+			require.Equal(t, tt.expectedCalls, flaky.calls)
+		})
+	}
+}
+
+// lostResponseKMSClient creates keys but fails the first calls to CreateKey as
+// if their response was lost, with an internal error or, when timeout is set,
+// once their context expires. It counts the calls to ListKeys, and fails
+// ListResourceTags with listTagsErr.
+type lostResponseKMSClient struct {
+	kmsClient
+
+	lostResponses int
+	timeout       bool
+	listTagsErr   error
+	calls         int
+	listKeysCalls int
+}
+
+func (c *lostResponseKMSClient) CreateKeyWithContext(ctx aws.Context, input *kms.CreateKeyInput, opts ...request.Option) (*kms.CreateKeyOutput, error) {
+	c.calls++
+	out, err := c.kmsClient.CreateKeyWithContext(ctx, input, opts...)
+	if err == nil && c.calls <= c.lostResponses {
+		if c.timeout {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return nil, awserr.New(kms.ErrCodeInternalException, "internal error", nil)
+	}
+	return out, err
+}
+
+func (c *lostResponseKMSClient) ListKeysWithContext(ctx aws.Context, input *kms.ListKeysInput, opts ...request.Option) (*kms.ListKeysOutput, error) {
+	c.listKeysCalls++
+	return c.kmsClient.ListKeysWithContext(ctx, input, opts...)
+}
+
+func (c *lostResponseKMSClient) ListResourceTagsWithContext(ctx aws.Context, input *kms.ListResourceTagsInput, opts ...request.Option) (*kms.ListResourceTagsOutput, error) {
+	if c.listTagsErr != nil {
+		return nil, c.listTagsErr
+	}
+	return c.kmsClient.ListResourceTagsWithContext(ctx, input, opts...)
+}
+
+// throttledCreateKeyClient throttles the first call to CreateKey, without
+// creating a key, and counts the calls to ListKeys
+type throttledCreateKeyClient struct {
+	kmsClient
+
+	calls         int
+	listKeysCalls int
+}
+
+func (c *throttledCreateKeyClient) CreateKeyWithContext(ctx aws.Context, input *kms.CreateKeyInput, opts ...request.Option) (*kms.CreateKeyOutput, error) {
+	c.calls++
+	if c.calls == 1 {
+		return nil, awserr.New("ThrottlingException", "rate exceeded", nil)
+	}
+	return c.kmsClient.CreateKeyWithContext(ctx, input, opts...)
+}
+
+func (c *throttledCreateKeyClient) ListKeysWithContext(ctx aws.Context, input *kms.ListKeysInput, opts ...request.Option) (*kms.ListKeysOutput, error) {
+	c.listKeysCalls++
+	return c.kmsClient.ListKeysWithContext(ctx, input, opts...)
+}
+
+func TestGenerateKeyReusesKeyOfLostResponse(t *testing.T) {
+	fake := newKMSClientFake(t)
+	lost := &lostResponseKMSClient{kmsClient: fake, lostResponses: 1}
+
+	p := newPlugin(func(c *Config) (kmsClient, error) {
+		return lost, nil
+	})
+	p.SetLogger(hclog.NewNullLogger())
+	_, err := p.Configure(ctx, &plugin.ConfigureRequest{
+		Configuration: fmt.Sprintf(`{"region": "%s", "max_retries": 2, "key_policy": "{}"}`, validRegion),
+	})
+	require.NoError(t, err)
+
+	resp, err := p.GenerateKey(ctx, &keymanager.GenerateKeyRequest{
+		KeyId:   spireKeyID,
+		KeyType: keymanager.KeyType_EC_P256,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, resp.PublicKey)
+	require.Equal(t, 1, lost.calls)
+
+	// The key created by the lost attempt is used instead of a second one
+	entries := fake.keyEntries()
+	require.Len(t, entries, 1)
+	require.NotEmpty(t, entries[0].Tags[requestIDTagKey])
+	target, ok := fake.aliasTarget(spireKeyAlias)
+	require.True(t, ok)
+	require.Equal(t, entries[0].KeyID, target)
+}
+
+func TestCreateKeyRetries(t *testing.T) {
+	createKey := func(t *testing.T, client kmsClient, timeout time.Duration) (*kms.CreateKeyOutput, error) {
+		retry := newRetryClient(client, timeout, 2)
+		retry.baseDelay = time.Millisecond
+		return retry.CreateKeyWithContext(context.Background(), &kms.CreateKeyInput{
+			CustomerMasterKeySpec: aws.String(kms.CustomerMasterKeySpecEccNistP256),
+			KeyUsage:              aws.String(spireKeyUsage),
+			Tags: []*kms.Tag{
+				{TagKey: aws.String(requestIDTagKey), TagValue: aws.String("request-id")},
+			},
+		})
+	}
+
+	t.Run("timed out", func(t *testing.T) {
+		fake := newKMSClientFake(t)
+		lost := &lostResponseKMSClient{kmsClient: fake, lostResponses: 1, timeout: true}
+		out, err := createKey(t, lost, 100*time.Millisecond)
+		require.NoError(t, err)
+		require.Equal(t, 1, lost.calls)
+		require.Equal(t, 1, lost.listKeysCalls)
+		entries := fake.keyEntries()
+		require.Len(t, entries, 1)
+		require.Equal(t, entries[0].KeyID, aws.StringValue(out.KeyMetadata.KeyId))
+	})
+
+	t.Run("throttled", func(t *testing.T) {
+		fake := newKMSClientFake(t)
+		throttled := &throttledCreateKeyClient{kmsClient: fake}
+		_, err := createKey(t, throttled, time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, 2, throttled.calls)
+		require.Zero(t, throttled.listKeysCalls)
+		require.Len(t, fake.keyEntries(), 1)
+	})
+
+	t.Run("tags not listed", func(t *testing.T) {
+		fake := newKMSClientFake(t)
+		lost := &lostResponseKMSClient{
+			kmsClient:     fake,
+			lostResponses: 1,
+			listTagsErr:   awserr.New("AccessDeniedException", "denied", nil),
+		}
+		_, err := createKey(t, lost, time.Minute)
+		require.EqualError(t, err, "AccessDeniedException: denied")
+		require.Equal(t, 1, lost.calls)
+		require.Len(t, fake.keyEntries(), 1)
+	})
+}
+
+func TestGenerateKeyWithRequestID(t *testing.T) {
+	fake := newKMSClientFake(t)
+	p := newPlugin(func(c *Config) (kmsClient, error) {
+		return fake, nil
+	})
+	p.SetLogger(hclog.NewNullLogger())
+	_, err := p.Configure(ctx, &plugin.ConfigureRequest{
+		Configuration: fmt.Sprintf(`{"region": "%s", "key_policy": "{}"}`, validRegion),
+	})
+	require.NoError(t, err)
+
+	_, err = p.GenerateKey(ContextWithRequestID(ctx, "request-id"), &keymanager.GenerateKeyRequest{
+		KeyId:   spireKeyID,
+		KeyType: keymanager.KeyType_EC_P256,
+	})
+	require.NoError(t, err)
+	entries := fake.keyEntries()
+	require.Len(t, entries, 1)
+	require.Equal(t, "request-id", entries[0].Tags[requestIDTagKey])
+
+	_, err = p.GenerateKey(ContextWithRequestID(ctx, strings.Repeat("a", maxTagValueLength+1)), &keymanager.GenerateKeyRequest{
+		KeyId:   spireKeyID,
+		KeyType: keymanager.KeyType_EC_P256,
+	})
+	require.EqualError(t, err, "kms: request id is longer than 256 characters")
+}
+
+func TestIsRetryableError(t *testing.T) {
+	for _, tt := range []struct {
+		err       error
+		retryable bool
+	}{
+		{err: awserr.New("ThrottlingException", "", nil), retryable: true},
+		{err: awserr.New("RequestError", "", nil), retryable: true},
+		{err: awserr.New(kms.ErrCodeInternalException, "", nil), retryable: true},
+		{err: awserr.New(kms.ErrCodeKeyUnavailableException, "", nil), retryable: true},
+		{err: awserr.New(kms.ErrCodeDependencyTimeoutException, "", nil), retryable: true},
+		{err: awserr.NewRequestFailure(awserr.New("InternalFailure", "", nil), 500, ""), retryable: true},
+		{err: awserr.NewRequestFailure(awserr.New("AccessDeniedException", "", nil), 400, ""), retryable: false},
+		{err: awserr.New(kms.ErrCodeNotFoundException, "", nil), retryable: false},
+		{err: awserr.New(kms.ErrCodeDisabledException, "", nil), retryable: false},
+		{err: fmt.Errorf("wrapped: %w", awserr.New("ThrottlingException", "", nil)), retryable: true},
+		{err: errors.New("some error"), retryable: false},
+		{err: context.Canceled, retryable: false},
+		{err: context.DeadlineExceeded, retryable: false},
+	} {
+		require.Equal(t, tt.retryable, isRetryableError(tt.err), "%v", tt.err)
+	}
+
+	// Neither throttling nor errors of other origins make a region unavailable
+	require.True(t, isRegionUnavailableError(awserr.New(kms.ErrCodeInternalException, "", nil)))
+	require.False(t, isRegionUnavailableError(fmt.Errorf("wrapped: %w", awserr.New("ThrottlingException", "", nil))))
+	require.False(t, isRegionUnavailableError(errors.New("some error")))
+}
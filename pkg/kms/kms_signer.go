@@ -0,0 +1,90 @@
+package kms
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"io"
+
+	"github.com/aws/aws-sdk-go/service/kms"
+
+	"github.com/spiffe/spire/proto/spire/server/keymanager"
+)
+
+// Signer returns a crypto.Signer backed by the current key of the given id,
+// e.g. to create certificates with crypto/x509 or to serve TLS. Signatures
+// are made by KMS through SignData. The signer is bound to the key it was
+// created with, and fails once GenerateKey replaced it.
+func (p *Plugin) Signer(spireKeyID string) (crypto.Signer, error) {
+	if err := p.checkConfigured(); err != nil {
+		return nil, err
+	}
+	entry, ok := p.entry(spireKeyID)
+	if !ok {
+		return nil, kmsErr.New("no such key %q", spireKeyID)
+	}
+
+	return &kmsSigner{
+		p:          p,
+		spireKeyID: spireKeyID,
+		kmsKeyID:   entry.KMSKeyID,
+		publicKey:  entry.ParsedPublicKey,
+	}, nil
+}
+
+type kmsSigner struct {
+	p          *Plugin
+	spireKeyID string
+	kmsKeyID   string
+	publicKey  crypto.PublicKey
+}
+
+func (s *kmsSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign signs digest with KMS. rand is not used, since KMS generates its own
+// randomness. ECDSA signatures are always ASN.1 DER, as crypto.Signer requires,
+// whatever the signature_encoding of SignData. The key is checked to still be
+// the one of the signer when it is picked to sign, so that the signature
+// always matches Public.
+func (s *kmsSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hashAlgo, err := hashAlgorithmFromCrypto(opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+
+	req := &keymanager.SignDataRequest{
+		KeyId: s.spireKeyID,
+		Data:  digest,
+	}
+	if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+		req.SignerOpts = &keymanager.SignDataRequest_PssOptions{
+			PssOptions: &keymanager.PSSOptions{
+				HashAlgorithm: hashAlgo,
+				SaltLength:    int32(pssOpts.SaltLength),
+			},
+		}
+	} else {
+		req.SignerOpts = &keymanager.SignDataRequest_HashAlgorithm{HashAlgorithm: hashAlgo}
+	}
+
+	resp, _, err := s.p.signData(context.Background(), req, kms.MessageTypeDigest, signatureEncodingDER, s.kmsKeyID)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Signature, nil
+}
+
+func hashAlgorithmFromCrypto(hash crypto.Hash) (keymanager.HashAlgorithm, error) {
+	switch hash {
+	case crypto.SHA256:
+		return keymanager.HashAlgorithm_SHA256, nil
+	case crypto.SHA384:
+		return keymanager.HashAlgorithm_SHA384, nil
+	case crypto.SHA512:
+		return keymanager.HashAlgorithm_SHA512, nil
+	default:
+		return keymanager.HashAlgorithm_UNSPECIFIED_HASH_ALGORITHM, kmsErr.New("unsupported hash function %v", hash)
+	}
+}
@@ -0,0 +1,189 @@
+package kms
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/hashicorp/go-hclog"
+	"github.com/spiffe/spire/pkg/server/plugin/keymanager"
+	"github.com/spiffe/spire/proto/spire/common/plugin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigner(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		keySpec   string
+		algorithm x509.SignatureAlgorithm
+	}{
+		{
+			name:      "EC P256",
+			keySpec:   kms.CustomerMasterKeySpecEccNistP256,
+			algorithm: x509.ECDSAWithSHA256,
+		},
+		{
+			name:      "EC P384",
+			keySpec:   kms.CustomerMasterKeySpecEccNistP384,
+			algorithm: x509.ECDSAWithSHA384,
+		},
+		{
+			name:      "RSA PKCS1v15",
+			keySpec:   kms.CustomerMasterKeySpecRsa2048,
+			algorithm: x509.SHA256WithRSA,
+		},
+		{
+			name:      "RSA PSS",
+			keySpec:   kms.CustomerMasterKeySpecRsa4096,
+			algorithm: x509.SHA512WithRSAPSS,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := newSignerTestPlugin(t, tt.keySpec, "")
+
+			signer, err := p.Signer(spireKeyID)
+			require.NoError(t, err)
+
+			template := &x509.Certificate{
+				SerialNumber:          big.NewInt(1),
+				Subject:               pkix.Name{CommonName: "spire-server"},
+				NotBefore:             time.Now(),
+				NotAfter:              time.Now().Add(time.Hour),
+				BasicConstraintsValid: true,
+				IsCA:                  true,
+				KeyUsage:              x509.KeyUsageCertSign,
+				SignatureAlgorithm:    tt.algorithm,
+			}
+			certDER, err := x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+			require.NoError(t, err)
+
+			cert, err := x509.ParseCertificate(certDER)
+			require.NoError(t, err)
+			require.NoError(t, cert.CheckSignatureFrom(cert))
+		})
+	}
+}
+
+func TestSignerWithRawSignatureEncoding(t *testing.T) {
+	p := newSignerTestPlugin(t, kms.CustomerMasterKeySpecEccNistP256, signatureEncodingRaw)
+	signer, err := p.Signer(spireKeyID)
+	require.NoError(t, err)
+	publicKey, ok := signer.Public().(*ecdsa.PublicKey)
+	require.True(t, ok)
+
+	// The signer returns DER, while SignData returns r || s
+	sum := sha256.Sum256([]byte("data"))
+	signature, err := signer.Sign(rand.Reader, sum[:], crypto.SHA256)
+	require.NoError(t, err)
+	require.True(t, ecdsa.VerifyASN1(publicKey, sum[:], signature))
+
+	resp, err := p.SignData(ctx, &keymanager.SignDataRequest{
+		KeyId:      spireKeyID,
+		Data:       sum[:],
+		SignerOpts: hashAlgorithmOpts(keymanager.HashAlgorithm_SHA256),
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.Signature, 64)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "spire-server"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, publicKey, signer)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(certDER)
+	require.NoError(t, err)
+	require.NoError(t, cert.CheckSignatureFrom(cert))
+}
+
+func TestSignerErrors(t *testing.T) {
+	p := newSignerTestPlugin(t, kms.CustomerMasterKeySpecRsa2048, "")
+
+	_, err := p.Signer("missing")
+	require.EqualError(t, err, `kms: no such key "missing"`)
+
+	signer, err := p.Signer(spireKeyID)
+	require.NoError(t, err)
+
+	sum := sha256.Sum256([]byte("data"))
+	_, err = signer.Sign(rand.Reader, sum[:], crypto.SHA1)
+	require.EqualError(t, err, "kms: unsupported hash function SHA-1")
+
+	_, err = signer.Sign(rand.Reader, sum[:], &rsa.PSSOptions{Hash: crypto.SHA256, SaltLength: rsa.PSSSaltLengthEqualsHash})
+	require.NoError(t, err)
+
+	// The signer is bound to the key it was created with
+	_, err = p.GenerateKey(ctx, &keymanager.GenerateKeyRequest{
+		KeyId:   spireKeyID,
+		KeyType: keymanager.KeyType_RSA_2048,
+	})
+	require.NoError(t, err)
+	_, err = signer.Sign(rand.Reader, sum[:], crypto.SHA256)
+	require.EqualError(t, err, `kms: key "spireKeyID" was replaced since the signer was created`)
+}
+
+func TestSignerWithConcurrentGenerateKey(t *testing.T) {
+	p := newSignerTestPlugin(t, kms.CustomerMasterKeySpecEccNistP256, "")
+	signer, err := p.Signer(spireKeyID)
+	require.NoError(t, err)
+	publicKey := signer.Public().(*ecdsa.PublicKey)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := p.GenerateKey(ctx, &keymanager.GenerateKeyRequest{
+			KeyId:   spireKeyID,
+			KeyType: keymanager.KeyType_EC_P256,
+		})
+		errCh <- err
+	}()
+
+	// Every signature matches the public key of the signer, until the
+	// signer fails because its key was replaced
+	sum := sha256.Sum256([]byte("data"))
+	for {
+		signature, err := signer.Sign(rand.Reader, sum[:], crypto.SHA256)
+		if err != nil {
+			require.EqualError(t, err, `kms: key "spireKeyID" was replaced since the signer was created`)
+			break
+		}
+		require.True(t, ecdsa.VerifyASN1(publicKey, sum[:], signature))
+	}
+	require.NoError(t, <-errCh)
+}
+
+func newSignerTestPlugin(t *testing.T, keySpec, signatureEncoding string) *Plugin {
+	fake := newKMSClientFake(t)
+	fake.setEntries([]fakeKeyEntry{
+		{
+			KeyID:        kmsKeyID,
+			AliasName:    spireKeyAlias,
+			KeySpec:      keySpec,
+			CreationDate: time.Now().Add(-time.Hour),
+		},
+	})
+
+	p := newPlugin(func(c *Config) (kmsClient, error) {
+		return fake, nil
+	})
+	p.SetLogger(hclog.NewNullLogger())
+	_, err := p.Configure(ctx, &plugin.ConfigureRequest{
+		Configuration: fmt.Sprintf(`{"region": "%s", "key_policy": "{}", "signature_encoding": %q}`, validRegion, signatureEncoding),
+	})
+	require.NoError(t, err)
+	return p
+}